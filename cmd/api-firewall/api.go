@@ -0,0 +1,259 @@
+package main
+
+import (
+	"net/url"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/wallarm/api-firewall/cmd/api-firewall/internal/handlers"
+	"github.com/wallarm/api-firewall/internal/config"
+	"github.com/wallarm/api-firewall/internal/platform/apikeys"
+	"github.com/wallarm/api-firewall/internal/platform/basicauth"
+	"github.com/wallarm/api-firewall/internal/platform/denylist"
+	"github.com/wallarm/api-firewall/internal/platform/geoip"
+	"github.com/wallarm/api-firewall/internal/platform/ipfilter"
+	"github.com/wallarm/api-firewall/internal/platform/metrics"
+	woauth2 "github.com/wallarm/api-firewall/internal/platform/oauth2"
+	"github.com/wallarm/api-firewall/internal/platform/proxy"
+	"github.com/wallarm/api-firewall/internal/platform/ratelimit"
+	"github.com/wallarm/api-firewall/internal/platform/router"
+	"github.com/wallarm/api-firewall/internal/platform/watcher"
+	"github.com/wallarm/api-firewall/internal/platform/web"
+)
+
+// api is the protected API described by the API spec. Each API has its own
+// upstream, validation modes and denylist.
+type api struct {
+	name    string
+	cfg     *config.APIFWConfiguration
+	logger  *logrus.Logger
+	handler *web.ReloadableHandler
+	pool    proxy.Pool
+
+	upstreamTLS *proxy.UpstreamTLS
+
+	deniedTokens *denylist.DeniedTokens
+	ipFilter     *ipfilter.Filter
+	geoDB        *geoip.Database
+	credentials  *basicauth.Credentials
+	apiKeys      *apikeys.Store
+	specWatcher  *watcher.Watcher
+
+	oauthValidator woauth2.OAuth2
+	oidcProviders  *woauth2.Providers
+}
+
+// newAPI loads the API spec, initializes the proxy pool and the denylist
+// and builds the request handler of the API. The components initialized
+// before the failed step are stopped on error.
+func newAPI(name string, cfg *config.APIFWConfiguration, shutdown chan os.Signal, logger *logrus.Logger) (_ *api, err error) {
+
+	// =========================================================================
+	// Init Swagger
+
+	apiSpecLocation := router.SpecLocation(cfg.APISpecs)
+
+	apiSpec, err := router.ReadSpec(apiSpecLocation)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading swagwaf file")
+	}
+
+	swagger, err := router.LoadSwagger(apiSpec, apiSpecLocation)
+	if err != nil {
+		return nil, errors.Wrap(err, "loading swagwaf file")
+	}
+
+	swagRouter, err := router.NewRouter(swagger)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing swagwaf file")
+	}
+
+	// =========================================================================
+	// Init Proxy Client
+
+	serverUrl, err := url.ParseRequestURI(cfg.Server.URL)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing proxy URL")
+	}
+	host := proxy.HostAddr(serverUrl)
+
+	a := api{
+		name:   name,
+		cfg:    cfg,
+		logger: logger,
+	}
+
+	defer func() {
+		if err != nil {
+			a.Close()
+		}
+	}()
+
+	initialCap := 100
+
+	if cfg.Server.ClientPoolCapacity < 100 {
+		initialCap = 1
+	}
+
+	if a.upstreamTLS, err = proxy.NewUpstreamTLS(&cfg.Server, logger); err != nil {
+		return nil, errors.Wrap(err, "upstream TLS init")
+	}
+
+	switch len(cfg.Server.Backends) {
+	case 0:
+		a.pool, err = proxy.NewChanPool(initialCap, cfg.Server.ClientPoolCapacity, host, &cfg.Server, a.upstreamTLS.Config)
+		if err != nil {
+			return nil, errors.Wrap(err, "proxy pool init")
+		}
+	default:
+		// requests are spread across the backends. The scheme and path of the
+		// backends should be the same as the scheme and path of the server URL
+		backendHosts, err := proxy.BackendHosts(serverUrl, cfg.Server.Backends)
+		if err != nil {
+			return nil, errors.Wrap(err, "configuration validation error")
+		}
+
+		logger.Infof("%s: %s: Spreading requests across %d backends (%s)", logPrefix, name, len(backendHosts), cfg.Server.LoadBalancing)
+
+		a.pool, err = proxy.NewBalancedPool(initialCap, cfg.Server.ClientPoolCapacity, backendHosts, cfg.Server.BackendWeights, &cfg.Server, a.upstreamTLS.Config, logger)
+		if err != nil {
+			return nil, errors.Wrap(err, "proxy pool init")
+		}
+	}
+
+	if err = metrics.RegisterPool(name, host, a.pool); err != nil {
+		return nil, errors.Wrap(err, "proxy pool metrics init")
+	}
+
+	// =========================================================================
+	// Init Cache
+
+	logger.Infof("%s: %s: Initializing Cache", logPrefix, name)
+
+	if a.deniedTokens, err = denylist.New(cfg, logger); err != nil {
+		return nil, errors.Wrap(err, "denylist init error")
+	}
+
+	if a.deniedTokens != nil {
+		logger.Infof("%s: %s: Loaded %d tokens to the cache", logPrefix, name, a.deniedTokens.Len())
+	}
+
+	// =========================================================================
+	// Init IP Allow and Deny Lists
+
+	if a.ipFilter, err = ipfilter.New(&cfg.IPFilter, logger); err != nil {
+		return nil, errors.Wrap(err, "IP filter init error")
+	}
+
+	// =========================================================================
+	// Init GeoIP Databases
+
+	if a.geoDB, err = geoip.New(&cfg.GeoIP, logger); err != nil {
+		return nil, errors.Wrap(err, "GeoIP init error")
+	}
+
+	// =========================================================================
+	// Init Basic Auth Credentials
+
+	if a.credentials, err = basicauth.New(&cfg.Server.BasicAuth, logger); err != nil {
+		return nil, errors.Wrap(err, "htpasswd init error")
+	}
+
+	// =========================================================================
+	// Init API Keys
+
+	if a.apiKeys, err = apikeys.New(&cfg.Server.APIKeys, logger); err != nil {
+		return nil, errors.Wrap(err, "API keys init error")
+	}
+
+	// =========================================================================
+	// Init OAuth2 Validator
+
+	if a.oauthValidator, err = woauth2.New(&cfg.Server.Oauth, logger); err != nil {
+		return nil, errors.Wrap(err, "OAuth2 init error")
+	}
+
+	a.oidcProviders = woauth2.NewProviders(&cfg.Server.Oauth, logger)
+
+	// validators, rate limits and the other components are shared by the
+	// handlers of the versions of the API spec
+	opts := handlers.ProxyOptions{
+		DeniedTokens:   a.deniedTokens,
+		Credentials:    a.credentials,
+		APIKeys:        a.apiKeys,
+		IPFilter:       a.ipFilter,
+		GeoIP:          a.geoDB,
+		OAuthValidator: a.oauthValidator,
+		RateLimiters:   ratelimit.NewRegistry(),
+		OIDCProviders:  a.oidcProviders,
+	}
+
+	handler, err := handlers.OpenapiProxy(cfg, serverUrl, shutdown, logger, a.pool, swagRouter, opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "building handler")
+	}
+
+	a.handler = web.NewReloadableHandler(handler)
+
+	// =========================================================================
+	// Init API Spec Watcher
+
+	if cfg.APISpecsUpdateInterval > 0 {
+		// the handler of the previous version of the spec is kept if the new version is invalid
+		updateSpec := handlers.SpecUpdater(a.handler, apiSpecLocation, cfg, serverUrl, shutdown, logger, a.pool, opts)
+
+		a.specWatcher = watcher.New(cfg.APISpecs, cfg.APISpecsUpdateInterval, func() ([]byte, error) {
+			return router.ReadSpec(apiSpecLocation)
+		}, updateSpec, logger)
+
+		logger.Infof("%s: %s: Watching API Spec for changes every %s", logPrefix, name, cfg.APISpecsUpdateInterval)
+
+		a.specWatcher.Start(apiSpec)
+	}
+
+	return &a, nil
+}
+
+// Close stops the API spec, denylist, IP lists, GeoIP databases, htpasswd, API keys and
+// client certificate watchers, stops the OAuth2 validator and the OpenID providers and
+// closes the proxy pool
+func (a *api) Close() {
+	if a.specWatcher != nil {
+		a.specWatcher.Stop()
+	}
+
+	if a.deniedTokens != nil {
+		a.deniedTokens.Close()
+	}
+
+	if a.ipFilter != nil {
+		a.ipFilter.Close()
+	}
+
+	if a.geoDB != nil {
+		a.geoDB.Close()
+	}
+
+	if a.credentials != nil {
+		a.credentials.Close()
+	}
+
+	if a.apiKeys != nil {
+		a.apiKeys.Close()
+	}
+
+	woauth2.Stop(a.oauthValidator)
+
+	if a.oidcProviders != nil {
+		a.oidcProviders.Close()
+	}
+
+	if a.pool != nil {
+		a.pool.Close()
+	}
+
+	if a.upstreamTLS != nil {
+		a.upstreamTLS.Close()
+	}
+}
@@ -0,0 +1,147 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/valyala/fasthttp"
+	"github.com/wallarm/api-firewall/internal/platform/oauth2"
+	"github.com/wallarm/api-firewall/internal/platform/router"
+	"github.com/wallarm/api-firewall/internal/platform/routers"
+)
+
+// authzRule is the authorization rule of the operation evaluated with the
+// claims of the validated token. The rule is either the combination of the
+// rules (allOf, anyOf, not) or the condition on the claim. The claim should
+// contain one of the values, be equal to the request header or the path
+// parameter, or just be present in the token.
+type authzRule struct {
+	AllOf []authzRule `json:"allOf"`
+	AnyOf []authzRule `json:"anyOf"`
+	Not   *authzRule  `json:"not"`
+
+	Claim  string   `json:"claim"`
+	Values []string `json:"values"`
+	Header string   `json:"header"`
+	Param  string   `json:"param"`
+}
+
+// routeAuthz returns the authorization rule of the route
+func routeAuthz(route *routers.Route) (*authzRule, error) {
+	var rule authzRule
+
+	found, err := router.Extension(route, router.ExtAuthz, &rule)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	if err := rule.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", router.ExtAuthz, err)
+	}
+
+	return &rule, nil
+}
+
+// validate checks that each rule is either the combination or the condition
+func (r *authzRule) validate() error {
+	kinds := 0
+	if r.AllOf != nil {
+		kinds++
+	}
+	if r.AnyOf != nil {
+		kinds++
+	}
+	if r.Not != nil {
+		kinds++
+	}
+	if r.Claim != "" {
+		kinds++
+	}
+
+	if kinds != 1 {
+		return errors.New("rule should contain exactly one of allOf, anyOf, not or claim")
+	}
+
+	if r.Claim != "" && ((len(r.Values) > 0 && (r.Header != "" || r.Param != "")) || (r.Header != "" && r.Param != "")) {
+		return fmt.Errorf("claim %s: only one of values, header or param should be set", r.Claim)
+	}
+
+	for _, rules := range [][]authzRule{r.AllOf, r.AnyOf} {
+		for i := range rules {
+			if err := rules[i].validate(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if r.Not != nil {
+		return r.Not.validate()
+	}
+
+	return nil
+}
+
+// allows evaluates the rule
+func (r *authzRule) allows(ctx *fasthttp.RequestCtx, pathParams map[string]string, claims oauth2.Claims) bool {
+	switch {
+	case r.AllOf != nil:
+		for i := range r.AllOf {
+			if !r.AllOf[i].allows(ctx, pathParams, claims) {
+				return false
+			}
+		}
+		return true
+	case r.AnyOf != nil:
+		for i := range r.AnyOf {
+			if r.AnyOf[i].allows(ctx, pathParams, claims) {
+				return true
+			}
+		}
+		return false
+	case r.Not != nil:
+		return !r.Not.allows(ctx, pathParams, claims)
+	}
+
+	values := claims.Values(r.Claim)
+	if values == nil {
+		return false
+	}
+
+	expected := r.Values
+	switch {
+	case r.Header != "":
+		header := ctx.Request.Header.Peek(r.Header)
+		if header == nil {
+			return false
+		}
+		expected = []string{string(header)}
+	case r.Param != "":
+		param, ok := pathParams[r.Param]
+		if !ok {
+			return false
+		}
+		expected = []string{param}
+	}
+
+	if len(expected) == 0 {
+		return true
+	}
+
+	for _, value := range values {
+		for _, e := range expected {
+			if value == e {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// check returns the error if the rule denies the request
+func (r *authzRule) check(ctx *fasthttp.RequestCtx, pathParams map[string]string, claims oauth2.Claims) error {
+	if !r.allows(ctx, pathParams, claims) {
+		return &oauth2.ValidationError{Reason: oauth2.ReasonAccessDenied, Err: errors.New("authorization rule denied the request")}
+	}
+	return nil
+}
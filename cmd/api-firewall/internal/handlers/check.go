@@ -13,31 +13,72 @@ type Health struct {
 	Build  string
 	Logger *logrus.Logger
 	Pool   proxy.Pool
+
+	// SpecPools contains the pools of each API spec if several API specs are configured
+	SpecPools map[string]proxy.Pool
 }
 
-// Readiness checks if the Fasthttp connection pool is ready to handle new requests.
-func (h Health) Readiness(ctx *fasthttp.RequestCtx) error {
+type poolStatus struct {
+	Status   string                `json:"status"`
+	Backends []proxy.BackendStatus `json:"backends,omitempty"`
+}
 
-	status := "ok"
-	statusCode := fasthttp.StatusOK
+// checkPool checks if the pool is able to return a client. If the requests
+// are spread across several backends, the health of each backend is reported.
+func checkPool(pool proxy.Pool) (poolStatus, bool) {
+
+	status := poolStatus{Status: "ok"}
+	ready := true
 
-	reverseProxy, err := h.Pool.Get()
+	if reporter, ok := pool.(proxy.BackendsReporter); ok {
+		status.Backends = reporter.Backends()
+	}
+
+	reverseProxy, err := pool.Get()
 	if err != nil {
-		status = "not ready"
-		statusCode = fasthttp.StatusInternalServerError
+		status.Status = "not ready"
+		ready = false
 	}
 
 	if reverseProxy != nil {
-		if err := h.Pool.Put(reverseProxy); err != nil {
-			status = "not ready"
+		if err := pool.Put(reverseProxy); err != nil {
+			status.Status = "not ready"
+			ready = false
+		}
+	}
+
+	return status, ready
+}
+
+// Readiness checks if the Fasthttp connection pool is ready to handle new requests.
+// If several API specs are configured, the pool of each API spec is checked.
+func (h Health) Readiness(ctx *fasthttp.RequestCtx) error {
+
+	statusCode := fasthttp.StatusOK
+
+	if len(h.SpecPools) == 0 {
+		data, ready := checkPool(h.Pool)
+		if !ready {
 			statusCode = fasthttp.StatusInternalServerError
 		}
+		return web.Respond(ctx, data, statusCode)
 	}
 
 	data := struct {
-		Status string `json:"status"`
+		Status string                `json:"status"`
+		Specs  map[string]poolStatus `json:"specs"`
 	}{
-		Status: status,
+		Status: "ok",
+		Specs:  make(map[string]poolStatus, len(h.SpecPools)),
+	}
+
+	for name, pool := range h.SpecPools {
+		status, ready := checkPool(pool)
+		if !ready {
+			data.Status = "not ready"
+			statusCode = fasthttp.StatusInternalServerError
+		}
+		data.Specs[name] = status
 	}
 
 	return web.Respond(ctx, data, statusCode)
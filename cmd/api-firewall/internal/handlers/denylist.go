@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+	"github.com/wallarm/api-firewall/internal/platform/denylist"
+	"github.com/wallarm/api-firewall/internal/platform/web"
+)
+
+// DenylistAdmin is the runtime management API of the denylist. The requests
+// are authenticated by the admin token in the Authorization header. If
+// several API specs are configured, the denylist of the API spec is selected
+// by the spec query parameter.
+type DenylistAdmin struct {
+	AdminToken string
+	Logger     *logrus.Logger
+	Tokens     *denylist.DeniedTokens
+
+	// SpecTokens contains the denylists of each API spec if several API specs are configured
+	SpecTokens map[string]*denylist.DeniedTokens
+}
+
+type denylistRequest struct {
+	Tokens    []string  `json:"tokens"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+type denylistError struct {
+	Error string `json:"error"`
+}
+
+// Handle lists (GET), adds (POST) or removes (DELETE) the denied tokens. The
+// tokens are either the plaintext tokens, the claims in the claim:value
+// format or the digests with the sha256: prefix. The added tokens expire at
+// the optional expiresAt time.
+func (d DenylistAdmin) Handle(ctx *fasthttp.RequestCtx) error {
+
+	if !d.authorized(ctx) {
+		ctx.Response.Header.Set(fasthttp.HeaderWWWAuthenticate, "Bearer")
+		return web.Respond(ctx, denylistError{Error: "unauthorized"}, fasthttp.StatusUnauthorized)
+	}
+
+	deniedTokens, err := d.denylist(ctx)
+	if err != nil {
+		return web.Respond(ctx, denylistError{Error: err.Error()}, fasthttp.StatusNotFound)
+	}
+
+	switch string(ctx.Method()) {
+	case fasthttp.MethodGet:
+		entries := deniedTokens.List()
+		return web.Respond(ctx, struct {
+			Total  int              `json:"total"`
+			Tokens []denylist.Entry `json:"tokens"`
+		}{Total: len(entries), Tokens: entries}, fasthttp.StatusOK)
+	case fasthttp.MethodPost, fasthttp.MethodDelete:
+	default:
+		ctx.Response.Header.Set(fasthttp.HeaderAllow, "GET, POST, DELETE")
+		return web.Respond(ctx, denylistError{Error: "method not allowed"}, fasthttp.StatusMethodNotAllowed)
+	}
+
+	var req denylistRequest
+	if err := json.Unmarshal(ctx.PostBody(), &req); err != nil || len(req.Tokens) == 0 {
+		return web.Respond(ctx, denylistError{Error: "request body should contain the list of tokens"}, fasthttp.StatusBadRequest)
+	}
+
+	var changed int
+	var result string
+
+	switch string(ctx.Method()) {
+	case fasthttp.MethodPost:
+		changed, err = deniedTokens.Add(req.Tokens, req.ExpiresAt)
+		result = "added"
+	case fasthttp.MethodDelete:
+		changed, err = deniedTokens.Remove(req.Tokens)
+		result = "removed"
+	}
+
+	switch {
+	case errors.Is(err, denylist.ErrInvalidToken):
+		return web.Respond(ctx, denylistError{Error: err.Error()}, fasthttp.StatusBadRequest)
+	case err != nil:
+		d.Logger.Errorf("denylist: %d tokens %s, the denylist has not been saved: %s", changed, result, err)
+		return web.Respond(ctx, denylistError{Error: "the denylist has not been saved"}, fasthttp.StatusInternalServerError)
+	}
+
+	d.Logger.Infof("denylist: %d tokens %s", changed, result)
+
+	return web.Respond(ctx, map[string]int{result: changed}, fasthttp.StatusOK)
+}
+
+// authorized checks the admin token of the request
+func (d DenylistAdmin) authorized(ctx *fasthttp.RequestCtx) bool {
+	token := ctx.Request.Header.Peek(fasthttp.HeaderAuthorization)
+	if len(token) < len("Bearer ") || string(token[:len("Bearer ")]) != "Bearer " {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare(token[len("Bearer "):], []byte(d.AdminToken)) == 1
+}
+
+// denylist returns the denylist selected by the request
+func (d DenylistAdmin) denylist(ctx *fasthttp.RequestCtx) (*denylist.DeniedTokens, error) {
+	if d.SpecTokens == nil {
+		if d.Tokens == nil {
+			return nil, errors.New("denylist is not configured")
+		}
+		return d.Tokens, nil
+	}
+
+	spec := string(ctx.QueryArgs().Peek("spec"))
+	if spec == "" {
+		return nil, errors.New("spec query parameter is required")
+	}
+
+	deniedTokens, found := d.SpecTokens[spec]
+	if !found || deniedTokens == nil {
+		return nil, fmt.Errorf("denylist of the API spec %q is not configured", spec)
+	}
+
+	return deniedTokens, nil
+}
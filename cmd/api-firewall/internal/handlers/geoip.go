@@ -0,0 +1,31 @@
+package handlers
+
+import (
+	"fmt"
+
+	"github.com/wallarm/api-firewall/internal/platform/geoip"
+	"github.com/wallarm/api-firewall/internal/platform/router"
+	"github.com/wallarm/api-firewall/internal/platform/routers"
+)
+
+// routeGeoIPRules returns the country and ASN rules set by the vendor
+// extension of the route. The rules of the route are checked in addition to
+// the global rules. The databases used by the rules should be loaded.
+func routeGeoIPRules(route *routers.Route, db *geoip.Database) (*geoip.Rules, error) {
+	var rules geoip.Rules
+
+	found, err := router.Extension(route, router.ExtGeoIP, &rules)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	if rules.Empty() {
+		return nil, fmt.Errorf("%s: no rule is set", router.ExtGeoIP)
+	}
+
+	if err := rules.Validate(db); err != nil {
+		return nil, fmt.Errorf("%s: %w", router.ExtGeoIP, err)
+	}
+
+	return &rules, nil
+}
@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wallarm/api-firewall/internal/config"
+	"github.com/wallarm/api-firewall/internal/platform/ipfilter"
+	"github.com/wallarm/api-firewall/internal/platform/router"
+	"github.com/wallarm/api-firewall/internal/platform/routers"
+)
+
+// routeIPFilter returns the IP allow and deny lists of the route. The lists
+// of the route are checked in addition to the global lists.
+func routeIPFilter(route *routers.Route, logger *logrus.Logger) (*ipfilter.Filter, error) {
+	allow, err := routeIPList(route, router.ExtIPAllow, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	deny, err := routeIPList(route, router.ExtIPDeny, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	if allow == nil && deny == nil {
+		return nil, nil
+	}
+
+	return &ipfilter.Filter{Allow: allow, Deny: deny}, nil
+}
+
+// routeIPList returns the list of the IP addresses and CIDRs set by the
+// vendor extension of the route
+func routeIPList(route *routers.Route, extension string, logger *logrus.Logger) (*ipfilter.List, error) {
+	var entries []string
+
+	found, err := router.Extension(route, extension, &entries)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("%s: list is empty", extension)
+	}
+
+	return ipfilter.NewList(extension, &config.IPList{Entries: entries}, 0, logger)
+}
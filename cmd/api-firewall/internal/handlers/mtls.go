@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/wallarm/api-firewall/internal/platform/router"
+	"github.com/wallarm/api-firewall/internal/platform/routers"
+	"github.com/wallarm/api-firewall/internal/platform/web"
+)
+
+var (
+	errClientCertRequired   = errors.New("client certificate required")
+	errClientCertNotAllowed = errors.New("client certificate is not allowed")
+)
+
+// clientCertsExtension is the allowlist of the client certificates of the
+// operation protected by the mutualTLS security scheme. The certificate is
+// allowed if the subject (or its common name), one of the SANs or the
+// SHA-256 fingerprint is in the list.
+type clientCertsExtension struct {
+	Subjects     []string `json:"subjects"`
+	SANs         []string `json:"sans"`
+	Fingerprints []string `json:"fingerprints"`
+}
+
+// routeClientCerts returns the client certificates allowlist of the route
+func routeClientCerts(route *routers.Route) (*clientCertsExtension, error) {
+	var ext clientCertsExtension
+
+	found, err := router.Extension(route, router.ExtClientCerts, &ext)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	if len(ext.Subjects) == 0 && len(ext.SANs) == 0 && len(ext.Fingerprints) == 0 {
+		return nil, fmt.Errorf("%s: subjects, sans or fingerprints should be set", router.ExtClientCerts)
+	}
+
+	return &ext, nil
+}
+
+// allows checks that the certificate is in the allowlist
+func (c *clientCertsExtension) allows(cert *x509.Certificate) bool {
+	for _, subject := range c.Subjects {
+		if subject == cert.Subject.String() || subject == cert.Subject.CommonName {
+			return true
+		}
+	}
+
+	for _, allowed := range c.SANs {
+		for _, san := range web.CertificateSANs(cert) {
+			if allowed == san {
+				return true
+			}
+		}
+	}
+
+	fingerprint := web.CertificateFingerprint(cert)
+	for _, allowed := range c.Fingerprints {
+		if strings.EqualFold(strings.Replace(allowed, ":", "", -1), fingerprint) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -14,6 +14,9 @@ import (
 	"github.com/valyala/fasthttp"
 	"github.com/valyala/fastjson"
 	"github.com/wallarm/api-firewall/internal/config"
+	"github.com/wallarm/api-firewall/internal/platform/apikeys"
+	"github.com/wallarm/api-firewall/internal/platform/basicauth"
+	"github.com/wallarm/api-firewall/internal/platform/metrics"
 	"github.com/wallarm/api-firewall/internal/platform/oauth2"
 	"github.com/wallarm/api-firewall/internal/platform/openapi3"
 	"github.com/wallarm/api-firewall/internal/platform/openapi3filter"
@@ -23,13 +26,42 @@ import (
 )
 
 type openapiWaf struct {
-	route           *routers.Route
-	proxyPool       proxy.Pool
-	logger          *logrus.Logger
-	cfg             *config.APIFWConfiguration
-	pathParamLength int
-	parserPool      *fastjson.ParserPool
-	oauthValidator  oauth2.OAuth2
+	route          *routers.Route
+	operation      string
+	proxyPool      proxy.Pool
+	logger         *logrus.Logger
+	cfg            *config.APIFWConfiguration
+	pathParamNames []string
+	parserPool     *fastjson.ParserPool
+	oauthValidator oauth2.OAuth2
+
+	// validators of the OpenID providers by the discovery URL
+	oidcValidators map[string]oauth2.OAuth2
+
+	// users of the basic authentication
+	credentials *basicauth.Credentials
+
+	// keys of the apiKey security schemes
+	apiKeys *apikeys.Store
+
+	// request headers with the claims of the validated token
+	claimHeaders []oauth2.ClaimHeader
+
+	// object-level authorization check of the operation
+	owner *ownerExtension
+
+	// authorization rule of the operation
+	authz *authzRule
+
+	// client certificates allowed by the mutualTLS security scheme
+	clientCerts *clientCertsExtension
+
+	// validation modes of the operation
+	requestValidation  string
+	responseValidation string
+
+	// claims required by the operation
+	requiredClaims oauth2.ClaimRequirements
 }
 
 // EXPERIMENTAL feature
@@ -102,12 +134,134 @@ func getValidationHeader(ctx *fasthttp.RequestCtx, err error) *string {
 	return nil
 }
 
+// returns the reason of the validation error which is used as the metrics label
+func getValidationReason(err error) string {
+	switch err := err.(type) {
+	case *openapi3filter.RequestError:
+		if err.Reason != "" {
+			return err.Reason
+		}
+		if err.Err == openapi3filter.ErrInvalidRequired {
+			return err.Err.Error()
+		}
+		if _, ok := err.Err.(*openapi3.SchemaError); ok {
+			return "doesn't match the schema"
+		}
+	case *openapi3filter.ResponseError:
+		if err.Reason != "" {
+			return err.Reason
+		}
+	case *openapi3filter.SecurityRequirementsError:
+		// the reason of the rejected token or credentials
+		for _, secErr := range err.Errors {
+			var tokenErr *oauth2.ValidationError
+			if errors.As(secErr, &tokenErr) {
+				return tokenErr.Reason
+			}
+			for _, credentialsErr := range []error{basicauth.ErrInvalidCredentials, basicauth.ErrOperationNotAllowed, apikeys.ErrUnknownKey, apikeys.ErrKeyExpired, apikeys.ErrOperationNotAllowed, errClientCertRequired, errClientCertNotAllowed} {
+				if errors.Is(secErr, credentialsErr) {
+					return credentialsErr.Error()
+				}
+			}
+		}
+		return "security requirements failed"
+	}
+
+	return "unknown"
+}
+
+// returns the RFC 7807 problem details of the validation error
+func getProblemDetails(ctx *fasthttp.RequestCtx, err error, statusCode int) *web.ProblemDetails {
+	problem := web.ProblemDetails{
+		Type:      web.ProblemDetailsDefaultType,
+		Title:     "Request validation failed",
+		Status:    statusCode,
+		RequestID: fmt.Sprintf("%016X", ctx.ID()),
+		Reason:    getValidationReason(err),
+	}
+
+	if _, ok := err.(*openapi3filter.ResponseError); ok {
+		problem.Title = "Response validation failed"
+		return &problem
+	}
+
+	if validationError := openapi3filter.NewValidationError(err); validationError != nil {
+		problem.Detail = validationError.Title
+		if validationError.Detail != "" {
+			problem.Detail += ": " + validationError.Detail
+		}
+		if validationError.Source != nil {
+			problem.Pointer = validationError.Source.Pointer
+			problem.Parameter = validationError.Source.Parameter
+		}
+	}
+
+	return &problem
+}
+
+// respondBlocked sends the response with the custom block status code. The
+// response contains the problem details body if it is enabled in the configuration
+func (s *openapiWaf) respondBlocked(ctx *fasthttp.RequestCtx, err error, statusHeader *string) error {
+	if s.cfg.ProblemDetailsResponse {
+		return web.RespondProblem(ctx, s.cfg.CustomBlockStatusCode, getProblemDetails(ctx, err, s.cfg.CustomBlockStatusCode), statusHeader)
+	}
+	return web.RespondError(ctx, s.cfg.CustomBlockStatusCode, statusHeader)
+}
+
+// forwardClaims replaces the client-supplied claim headers by the claims of
+// the validated token. The Authorization header is removed if it is enabled
+// in the configuration, also for the routes without the OAuth2 security.
+func (s *openapiWaf) forwardClaims(ctx *fasthttp.RequestCtx, claims oauth2.Claims) {
+	for _, h := range s.claimHeaders {
+		ctx.Request.Header.Del(h.Header)
+	}
+
+	if s.cfg.Server.Oauth.RemoveAuthorizationHeader {
+		ctx.Request.Header.Del("Authorization")
+	}
+
+	if claims == nil {
+		return
+	}
+
+	for _, h := range s.claimHeaders {
+		if value, ok := claims.HeaderValue(h.Claim); ok {
+			ctx.Request.Header.Set(h.Header, value)
+		}
+	}
+}
+
+// proxyRequest sends the request to the upstream. If the upstream request
+// fails the status code of the error response is returned
+func (s *openapiWaf) proxyRequest(ctx *fasthttp.RequestCtx, client proxy.HTTPClient) (int, error) {
+	start := time.Now()
+
+	if err := client.Do(&ctx.Request, &ctx.Response); err != nil {
+		s.logger.Errorf("#%016X : error while proxying request: %s", ctx.ID(), strings.Replace(err.Error(), "\n", " ", -1))
+		switch err {
+		case fasthttp.ErrDialTimeout:
+			metrics.UpstreamErrors.WithLabelValues(metrics.UpstreamDialTimeout).Inc()
+			return fasthttp.StatusGatewayTimeout, err
+		case fasthttp.ErrNoFreeConns:
+			metrics.UpstreamErrors.WithLabelValues(metrics.UpstreamNoFreeConns).Inc()
+			return fasthttp.StatusServiceUnavailable, err
+		default:
+			metrics.UpstreamErrors.WithLabelValues(metrics.UpstreamBadGateway).Inc()
+			return fasthttp.StatusBadGateway, err
+		}
+	}
+
+	metrics.UpstreamDuration.Observe(time.Since(start).Seconds())
+
+	return fasthttp.StatusOK, nil
+}
+
 func (s *openapiWaf) openapiWafHandler(ctx *fasthttp.RequestCtx) error {
 	s.logger.Debugf("New Request: #%016X : %s -> %s %s (%s)",
 		ctx.ID(),
 		ctx.RemoteAddr(),
 		ctx.Request.Header.Method(), ctx.Path(),
-		time.Since(ctx.Time()),
+		time.Since(web.RequestTime(ctx)),
 	)
 
 	client, err := s.proxyPool.Get()
@@ -118,22 +272,16 @@ func (s *openapiWaf) openapiWafHandler(ctx *fasthttp.RequestCtx) error {
 	defer s.proxyPool.Put(client)
 
 	// Handle request if Validation Disabled for request and response
-	if s.route == nil || (s.cfg.RequestValidation == web.ValidationDisable && s.cfg.ResponseValidation == web.ValidationDisable) {
-
-		if err := client.Do(&ctx.Request, &ctx.Response); err != nil {
-			s.logger.Errorf("#%016X : error while proxying request: %s", ctx.ID(), strings.Replace(err.Error(), "\n", " ", -1))
-			switch err {
-			case fasthttp.ErrDialTimeout:
-				return web.RespondError(ctx, fasthttp.StatusGatewayTimeout, nil)
-			case fasthttp.ErrNoFreeConns:
-				return web.RespondError(ctx, fasthttp.StatusServiceUnavailable, nil)
-			default:
-				return web.RespondError(ctx, fasthttp.StatusBadGateway, nil)
-			}
+	if s.route == nil || (s.requestValidation == web.ValidationDisable && s.responseValidation == web.ValidationDisable) {
+
+		s.forwardClaims(ctx, nil)
+
+		if statusCode, err := s.proxyRequest(ctx, client); err != nil {
+			return web.RespondError(ctx, statusCode, nil)
 		}
 
 		// check shadow api if path or method are not found and validation mode is LOG_ONLY
-		if s.route == nil && (s.cfg.RequestValidation == web.ValidationLog || s.cfg.ResponseValidation == web.ValidationLog) {
+		if s.route == nil && (s.requestValidation == web.ValidationLog || s.responseValidation == web.ValidationLog) {
 			web.ShadowAPIChecks(ctx, s.logger, &s.cfg.ShadowAPI)
 		}
 
@@ -142,15 +290,21 @@ func (s *openapiWaf) openapiWafHandler(ctx *fasthttp.RequestCtx) error {
 
 	var pathParams map[string]string
 
-	if s.pathParamLength > 0 {
-		pathParams = make(map[string]string, s.pathParamLength)
+	// the user values also hold the labels of the middlewares, so only the
+	// declared path parameters are taken
+	if len(s.pathParamNames) > 0 {
+		pathParams = make(map[string]string, len(s.pathParamNames))
 
-		ctx.VisitUserValues(func(key []byte, value interface{}) {
-			keyStr := strconv.B2S(key)
-			pathParams[keyStr] = value.(string)
-		})
+		for _, name := range s.pathParamNames {
+			if value, ok := ctx.UserValue(name).(string); ok {
+				pathParams[name] = value
+			}
+		}
 	}
 
+	// claims of the validated OAuth2 token
+	var tokenClaims oauth2.Claims
+
 	// Validate request
 	requestValidationInput := &openapi3filter.RequestValidationInput{
 		RequestCtx: ctx,
@@ -167,6 +321,15 @@ func (s *openapiWaf) openapiWafHandler(ctx *fasthttp.RequestCtx) error {
 						if bHeader == nil || !strings.HasPrefix(strings.ToLower(strconv.B2S(bHeader)), "basic ") {
 							return errors.New("missing basic authorization header")
 						}
+						if s.credentials != nil {
+							username, password, err := basicauth.ParseHeader(strconv.B2S(bHeader))
+							if err != nil {
+								return err
+							}
+							if err := s.credentials.Verify(username, password, s.operation); err != nil {
+								return fmt.Errorf("basic auth error: %w", err)
+							}
+						}
 					case "bearer":
 						bHeader := input.RequestValidationInput.RequestCtx.Request.Header.Peek("Authorization")
 						if bHeader == nil || !strings.HasPrefix(strings.ToLower(strconv.B2S(bHeader)), "bearer ") {
@@ -174,63 +337,94 @@ func (s *openapiWaf) openapiWafHandler(ctx *fasthttp.RequestCtx) error {
 						}
 					}
 				case "oauth2", "openIdConnect":
-					if s.oauthValidator == nil {
+					validator := s.oauthValidator
+					if oidcValidator, ok := s.oidcValidators[input.SecurityScheme.OpenIdConnectUrl]; ok && input.SecurityScheme.Type == "openIdConnect" {
+						validator = oidcValidator
+					}
+					if validator == nil {
 						return errors.New("oauth2 validator not configured")
 					}
-					if err := s.oauthValidator.Validate(ctx, string(input.RequestValidationInput.RequestCtx.Request.Header.Peek("Authorization")), input.Scopes); err != nil {
-						return fmt.Errorf("oauth2 error: %s", err)
+					claims, err := validator.Validate(ctx, string(input.RequestValidationInput.RequestCtx.Request.Header.Peek("Authorization")), input.Scopes)
+					if err == nil {
+						err = oauth2.CheckClaims(claims, s.requiredClaims)
+					}
+					if err == nil && s.authz != nil {
+						err = s.authz.check(input.RequestValidationInput.RequestCtx, pathParams, claims)
+					}
+					if err == nil && s.owner != nil {
+						err = s.owner.check(input.RequestValidationInput.RequestCtx, pathParams, claims, s.parserPool)
+					}
+					if err != nil {
+						metrics.OAuthFailures.WithLabelValues(strings.ToLower(s.cfg.Server.Oauth.ValidationType)).Inc()
+						return fmt.Errorf("oauth2 error: %w", err)
+					}
+					tokenClaims = claims
+
+				case "mutualTLS":
+					cert := web.ClientCertificate(input.RequestValidationInput.RequestCtx)
+					if cert == nil {
+						return errClientCertRequired
+					}
+					if s.clientCerts != nil && !s.clientCerts.allows(cert) {
+						return errClientCertNotAllowed
 					}
 
 				case "apiKey":
+					var apiKey []byte
 					switch input.SecurityScheme.In {
 					case "header":
-						if input.RequestValidationInput.RequestCtx.Request.Header.Peek(input.SecurityScheme.Name) == nil {
+						if apiKey = input.RequestValidationInput.RequestCtx.Request.Header.Peek(input.SecurityScheme.Name); apiKey == nil {
 							return fmt.Errorf("missing %s header", input.SecurityScheme.Name)
 						}
 					case "query":
-						if input.RequestValidationInput.RequestCtx.URI().QueryArgs().Peek(input.SecurityScheme.Name) == nil {
+						if apiKey = input.RequestValidationInput.RequestCtx.URI().QueryArgs().Peek(input.SecurityScheme.Name); apiKey == nil {
 							return fmt.Errorf("missing %s query parameter", input.SecurityScheme.Name)
 						}
 					case "cookie":
-						if input.RequestValidationInput.RequestCtx.Request.Header.Cookie(input.SecurityScheme.Name) == nil {
+						if apiKey = input.RequestValidationInput.RequestCtx.Request.Header.Cookie(input.SecurityScheme.Name); apiKey == nil {
 							return fmt.Errorf("missing %s cookie", input.SecurityScheme.Name)
 						}
 					}
+					if s.apiKeys != nil {
+						key, err := s.apiKeys.Verify(string(apiKey), s.operation, s.route.Operation.Tags)
+						if key != nil && key.Client != "" {
+							input.RequestValidationInput.RequestCtx.SetUserValue(web.ClientLabel, key.Client)
+						}
+						if err != nil {
+							return fmt.Errorf("api key error: %w", err)
+						}
+					}
 				}
 				return nil
 			},
 		},
 	}
 
-	switch s.cfg.RequestValidation {
+	switch s.requestValidation {
 	case web.ValidationBlock:
 		if err := openapi3filter.ValidateRequest(ctx, requestValidationInput); err != nil {
+			metrics.RequestValidationErrors.WithLabelValues(getValidationReason(err)).Inc()
 			s.logger.Errorf("#%016X : request validation error: %s", ctx.ID(), strings.Replace(err.Error(), "\n", " ", -1))
 			if s.cfg.AddValidationStatusHeader {
 				if vh := getValidationHeader(ctx, err); vh != nil {
 					s.logger.Errorf("add header %s: %s", web.ValidationStatus, *vh)
 					ctx.Request.Header.Add(web.ValidationStatus, *vh)
-					return web.RespondError(ctx, s.cfg.CustomBlockStatusCode, vh)
+					return s.respondBlocked(ctx, err, vh)
 				}
 			}
-			return web.RespondError(ctx, s.cfg.CustomBlockStatusCode, nil)
+			return s.respondBlocked(ctx, err, nil)
 		}
 	case web.ValidationLog:
 		if err := openapi3filter.ValidateRequest(ctx, requestValidationInput); err != nil {
+			metrics.RequestValidationErrors.WithLabelValues(getValidationReason(err)).Inc()
 			s.logger.Errorf("#%016X : request validation error: %s", ctx.ID(), strings.Replace(err.Error(), "\n", " ", -1))
 		}
 	}
 
-	if err := client.Do(&ctx.Request, &ctx.Response); err != nil {
-		s.logger.Errorf("#%016X : error while proxying request: %s", ctx.ID(), strings.Replace(err.Error(), "\n", " ", -1))
-		switch err {
-		case fasthttp.ErrDialTimeout:
-			return web.RespondError(ctx, fasthttp.StatusGatewayTimeout, nil)
-		case fasthttp.ErrNoFreeConns:
-			return web.RespondError(ctx, fasthttp.StatusServiceUnavailable, nil)
-		default:
-			return web.RespondError(ctx, fasthttp.StatusBadGateway, nil)
-		}
+	s.forwardClaims(ctx, tokenClaims)
+
+	if statusCode, err := s.proxyRequest(ctx, client); err != nil {
+		return web.RespondError(ctx, statusCode, nil)
 	}
 
 	responseValidationInput := &openapi3filter.ResponseValidationInput{
@@ -248,21 +442,23 @@ func (s *openapiWaf) openapiWafHandler(ctx *fasthttp.RequestCtx) error {
 	}
 
 	// Validate response
-	switch s.cfg.ResponseValidation {
+	switch s.responseValidation {
 	case web.ValidationBlock:
 		if err := openapi3filter.ValidateResponse(responseValidationInput); err != nil {
+			metrics.ResponseValidationErrors.WithLabelValues(getValidationReason(err)).Inc()
 			s.logger.Errorf("#%016X : response validation error :  %s", ctx.ID(), strings.Replace(err.Error(), "\n", " ", -1))
 			if s.cfg.AddValidationStatusHeader {
 				if vh := getValidationHeader(ctx, err); vh != nil {
 					s.logger.Errorf("add header %s: %s", web.ValidationStatus, *vh)
 					ctx.Response.Header.Add(web.ValidationStatus, *vh)
-					return web.RespondError(ctx, s.cfg.CustomBlockStatusCode, vh)
+					return s.respondBlocked(ctx, err, vh)
 				}
 			}
-			return web.RespondError(ctx, s.cfg.CustomBlockStatusCode, nil)
+			return s.respondBlocked(ctx, err, nil)
 		}
 	case web.ValidationLog:
 		if err := openapi3filter.ValidateResponse(responseValidationInput); err != nil {
+			metrics.ResponseValidationErrors.WithLabelValues(getValidationReason(err)).Inc()
 			s.logger.Errorf("#%016X : response validation error :  %s", ctx.ID(), strings.Replace(err.Error(), "\n", " ", -1))
 		}
 	}
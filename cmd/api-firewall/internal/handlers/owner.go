@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fastjson"
+	"github.com/wallarm/api-firewall/internal/platform/oauth2"
+	"github.com/wallarm/api-firewall/internal/platform/router"
+	"github.com/wallarm/api-firewall/internal/platform/routers"
+)
+
+// Locations of the owner parameter
+const (
+	ownerInPath  = "path"
+	ownerInQuery = "query"
+	ownerInBody  = "body"
+)
+
+// ownerExtension binds the request parameter to the claim of the token, so
+// the caller is allowed to access only its own objects. The body parameter is
+// the dot separated path of the JSON field. The check is skipped if the
+// token satisfies the bypass claims, e.g. for admin roles.
+type ownerExtension struct {
+	Param  string                   `json:"param"`
+	In     string                   `json:"in"`
+	Claim  string                   `json:"claim"`
+	Bypass oauth2.ClaimRequirements `json:"bypass"`
+}
+
+// routeOwner returns the owner check of the route
+func routeOwner(route *routers.Route) (*ownerExtension, error) {
+	var ext ownerExtension
+
+	found, err := router.Extension(route, router.ExtOwner, &ext)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	if ext.Param == "" || ext.Claim == "" {
+		return nil, fmt.Errorf("%s: param and claim should be set", router.ExtOwner)
+	}
+
+	switch ext.In {
+	case "":
+		ext.In = ownerInPath
+	case ownerInPath, ownerInQuery, ownerInBody:
+	default:
+		return nil, fmt.Errorf("%s: unsupported location %q", router.ExtOwner, ext.In)
+	}
+
+	return &ext, nil
+}
+
+// requiresToken reports whether each security requirement of the route
+// contains the oauth2 or the openIdConnect scheme. The owner and the authz
+// checks use the claims of the token, so they would be skipped for the
+// requests authenticated by the other schemes or not authenticated at all.
+func requiresToken(route *routers.Route) bool {
+	security := route.Swagger.Security
+	if route.Operation != nil && route.Operation.Security != nil {
+		security = *route.Operation.Security
+	}
+
+	if len(security) == 0 {
+		return false
+	}
+
+	for _, requirement := range security {
+		found := false
+		for name := range requirement {
+			scheme := route.Swagger.Components.SecuritySchemes[name]
+			if scheme != nil && scheme.Value != nil && (scheme.Value.Type == "oauth2" || scheme.Value.Type == "openIdConnect") {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// check checks that the value of the request parameter is one of the values
+// of the token claim
+func (o *ownerExtension) check(ctx *fasthttp.RequestCtx, pathParams map[string]string, claims oauth2.Claims, parserPool *fastjson.ParserPool) error {
+	if len(o.Bypass) > 0 && oauth2.CheckClaims(claims, o.Bypass) == nil {
+		return nil
+	}
+
+	value, ok := o.value(ctx, pathParams, parserPool)
+	if !ok {
+		return &oauth2.ValidationError{Reason: oauth2.ReasonOwnerMismatch, Err: fmt.Errorf("%s parameter %s not found", o.In, o.Param)}
+	}
+
+	for _, owner := range claims.Values(o.Claim) {
+		if owner == value {
+			return nil
+		}
+	}
+
+	return &oauth2.ValidationError{Reason: oauth2.ReasonOwnerMismatch, Err: fmt.Errorf("%s parameter %s doesn't match claim %s", o.In, o.Param, o.Claim)}
+}
+
+// value returns the value of the owner parameter of the request
+func (o *ownerExtension) value(ctx *fasthttp.RequestCtx, pathParams map[string]string, parserPool *fastjson.ParserPool) (string, bool) {
+	switch o.In {
+	case ownerInQuery:
+		value := ctx.QueryArgs().Peek(o.Param)
+		return string(value), value != nil
+	case ownerInBody:
+		parser := parserPool.Get()
+		defer parserPool.Put(parser)
+
+		body, err := parser.ParseBytes(ctx.Request.Body())
+		if err != nil {
+			return "", false
+		}
+
+		field := body.Get(strings.Split(o.Param, ".")...)
+		if field == nil {
+			return "", false
+		}
+
+		if field.Type() == fastjson.TypeString {
+			return string(field.GetStringBytes()), true
+		}
+		return field.String(), true
+	}
+
+	value, ok := pathParams[o.Param]
+	return value, ok
+}
@@ -0,0 +1,41 @@
+package handlers
+
+import (
+	"net/url"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/wallarm/api-firewall/internal/config"
+	"github.com/wallarm/api-firewall/internal/platform/proxy"
+	"github.com/wallarm/api-firewall/internal/platform/router"
+	"github.com/wallarm/api-firewall/internal/platform/watcher"
+	"github.com/wallarm/api-firewall/internal/platform/web"
+)
+
+// SpecUpdater returns the update function of the API spec watcher. The
+// handler of the new version of the spec is built with the same options, so
+// the state of the long-lived components is kept. The handler of the previous
+// version keeps serving the requests if the new version is invalid.
+func SpecUpdater(handler *web.ReloadableHandler, specLocation *url.URL, cfg *config.APIFWConfiguration, serverUrl *url.URL, shutdown chan os.Signal, logger *logrus.Logger, proxy proxy.Pool, opts ProxyOptions) watcher.UpdateFunc {
+	return func(data []byte) error {
+		swagger, err := router.LoadSwagger(data, specLocation)
+		if err != nil {
+			return errors.Wrap(err, "loading swagwaf file")
+		}
+
+		// the new spec is validated while the router is being built
+		swagRouter, err := router.NewRouter(swagger)
+		if err != nil {
+			return errors.Wrap(err, "parsing swagwaf file")
+		}
+
+		h, err := OpenapiProxy(cfg, serverUrl, shutdown, logger, proxy, swagRouter, opts)
+		if err != nil {
+			return errors.Wrap(err, "building handler")
+		}
+
+		handler.Swap(h)
+		return nil
+	}
+}
@@ -1,76 +1,121 @@
 package handlers
 
 import (
-	"crypto/rsa"
-	"io/ioutil"
+	"fmt"
 	"net/url"
 	"os"
 	"path"
-	"strings"
+	"time"
 
-	"github.com/golang-jwt/jwt"
-	"github.com/karlseguin/ccache/v2"
 	"github.com/sirupsen/logrus"
 	"github.com/valyala/fasthttp"
 	"github.com/valyala/fastjson"
 	"github.com/wallarm/api-firewall/internal/config"
 	"github.com/wallarm/api-firewall/internal/mid"
+	"github.com/wallarm/api-firewall/internal/platform/apikeys"
+	"github.com/wallarm/api-firewall/internal/platform/basicauth"
 	"github.com/wallarm/api-firewall/internal/platform/denylist"
+	"github.com/wallarm/api-firewall/internal/platform/geoip"
+	"github.com/wallarm/api-firewall/internal/platform/ipfilter"
 	woauth2 "github.com/wallarm/api-firewall/internal/platform/oauth2"
 	"github.com/wallarm/api-firewall/internal/platform/openapi3"
 	"github.com/wallarm/api-firewall/internal/platform/proxy"
+	"github.com/wallarm/api-firewall/internal/platform/ratelimit"
 	"github.com/wallarm/api-firewall/internal/platform/router"
+	"github.com/wallarm/api-firewall/internal/platform/routers"
 	"github.com/wallarm/api-firewall/internal/platform/web"
 )
 
-func OpenapiProxy(cfg *config.APIFWConfiguration, serverUrl *url.URL, shutdown chan os.Signal, logger *logrus.Logger, proxy proxy.Pool, swagRouter *router.Router, deniedTokens *denylist.DeniedTokens) fasthttp.RequestHandler {
+// ProxyOptions are the optional components of the API firewall. The
+// components which are not set are disabled. The components are long-lived:
+// they are shared by the handlers built from the versions of the API spec.
+type ProxyOptions struct {
+	DeniedTokens   *denylist.DeniedTokens
+	Credentials    *basicauth.Credentials
+	APIKeys        *apikeys.Store
+	IPFilter       *ipfilter.Filter
+	GeoIP          *geoip.Database
+	OAuthValidator woauth2.OAuth2
+
+	// RateLimiters keep the buckets of the rate limits and OIDCProviders keep
+	// the discovery documents and the keys of the openIdConnect schemes. They
+	// are not shared with the other handlers if they are not set.
+	RateLimiters  *ratelimit.Registry
+	OIDCProviders *woauth2.Providers
+}
+
+// OpenapiProxy builds the request handler of the API spec. It returns the
+// error if the handler of the spec can't be built.
+func OpenapiProxy(cfg *config.APIFWConfiguration, serverUrl *url.URL, shutdown chan os.Signal, logger *logrus.Logger, proxy proxy.Pool, swagRouter *router.Router, opts ProxyOptions) (fasthttp.RequestHandler, error) {
 
 	var parserPool fastjson.ParserPool
 
-	var oauthValidator woauth2.OAuth2
+	if opts.RateLimiters == nil {
+		opts.RateLimiters = ratelimit.NewRegistry()
+	}
 
-	switch strings.ToLower(cfg.Server.Oauth.ValidationType) {
-	case "jwt":
-		var key *rsa.PublicKey
-		if strings.HasPrefix(strings.ToLower(cfg.Server.Oauth.JWT.SignatureAlgorithm), "rs") {
-			verifyBytes, err := ioutil.ReadFile(cfg.Server.Oauth.JWT.PubCertFile)
-			if err != nil {
-				logger.Errorf("Error reading public key from file: %s", err)
-				break
-			}
+	if opts.OIDCProviders == nil {
+		opts.OIDCProviders = woauth2.NewProviders(&cfg.Server.Oauth, logger)
+	}
 
-			key, err = jwt.ParseRSAPublicKeyFromPEM(verifyBytes)
-			if err != nil {
-				logger.Errorf("Error parsing public key: %s", err)
-				break
+	// openIdConnect security schemes are validated by the providers declared in the spec
+	oidcValidators := make(map[string]woauth2.OAuth2)
+	if swagRouter.Swagger != nil {
+		for name, scheme := range swagRouter.Swagger.Components.SecuritySchemes {
+			if scheme.Value == nil || scheme.Value.Type != "openIdConnect" || scheme.Value.OpenIdConnectUrl == "" {
+				continue
 			}
-
-			logger.Infof("OAuth2: public certificate successfully loaded")
+			if _, ok := oidcValidators[scheme.Value.OpenIdConnectUrl]; ok {
+				continue
+			}
+			logger.Debugf("OAuth2: OIDC: provider of the security scheme %s: %s", name, scheme.Value.OpenIdConnectUrl)
+			oidcValidators[scheme.Value.OpenIdConnectUrl] = opts.OIDCProviders.Provider(scheme.Value.OpenIdConnectUrl)
 		}
+	}
 
-		oauthValidator = &woauth2.JWT{
-			Cfg:       &cfg.Server.Oauth,
-			Logger:    logger,
-			PubKey:    key,
-			SecretKey: []byte(cfg.Server.Oauth.JWT.SecretKey),
-		}
+	claimHeaders := woauth2.ParseClaimHeaders(cfg.Server.Oauth.ClaimHeaders)
+
+	trustedProxies, err := ipfilter.ParseNetworks(cfg.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("trusted proxies: %w", err)
+	}
 
-	case "introspection":
-		oauthValidator = &woauth2.Introspection{
-			Cfg:    &cfg.Server.Oauth,
-			Logger: logger,
-			Cache:  ccache.New(ccache.Configure()),
+	middlewares := []web.Middleware{mid.Logger(logger), mid.Errors(logger), mid.Panics(logger), mid.Proxy(cfg, serverUrl)}
+
+	// global IP allow and deny lists
+	if opts.IPFilter != nil {
+		middlewares = append(middlewares, mid.IPFilter(cfg, opts.IPFilter, trustedProxies, logger))
+	}
+
+	// global country and ASN rules
+	geoIPRules := geoip.NewRules(&cfg.GeoIP)
+	if geoIPRules != nil {
+		if err := geoIPRules.Validate(opts.GeoIP); err != nil {
+			return nil, fmt.Errorf("GeoIP: %w", err)
 		}
 	}
+
+	if opts.GeoIP != nil {
+		middlewares = append(middlewares, mid.GeoIP(cfg, opts.GeoIP, geoIPRules, trustedProxies, logger))
+	}
+
+	middlewares = append(middlewares, mid.Denylist(cfg, opts.DeniedTokens, logger))
+
+	// global rate limit
+	if cfg.RateLimit.Rate > 0 {
+		middlewares = append(middlewares, mid.RateLimit(cfg, &cfg.RateLimit, opts.RateLimiters, mid.RateLimitCredentials{APIKeys: opts.APIKeys, OAuth: opts.OAuthValidator}, trustedProxies, "", logger))
+	}
+
 	// Construct the web.App which holds all routes as well as common Middleware.
-	app := web.NewApp(shutdown, cfg, logger, mid.Logger(logger), mid.Errors(logger), mid.Panics(logger), mid.Proxy(cfg, serverUrl), mid.Denylist(cfg, deniedTokens, logger))
+	app := web.NewApp(shutdown, cfg, logger, middlewares...)
 
 	for _, route := range swagRouter.Routes {
-		pathParamLength := 0
+		// path parameters declared by the operation and the common parameters
+		var pathParamNames []string
 		if getOp := route.Route.PathItem.GetOperation(route.Method); getOp != nil {
 			for _, param := range getOp.Parameters {
 				if param.Value.In == openapi3.ParameterInPath {
-					pathParamLength += 1
+					pathParamNames = append(pathParamNames, param.Value.Name)
 				}
 			}
 		}
@@ -79,37 +124,234 @@ func OpenapiProxy(cfg *config.APIFWConfiguration, serverUrl *url.URL, shutdown c
 		if getOp := route.Route.PathItem.Parameters; getOp != nil {
 			for _, param := range getOp {
 				if param.Value.In == openapi3.ParameterInPath {
-					pathParamLength += 1
+					pathParamNames = append(pathParamNames, param.Value.Name)
 				}
 			}
 		}
 
+		updRoutePath := path.Join(serverUrl.Path, route.Path)
+
+		// operation is identified by the operationId or by the method and the path
+		operation := route.Method + " " + route.Path
+		if route.Route.Operation != nil && route.Route.Operation.OperationID != "" {
+			operation = route.Route.Operation.OperationID
+		}
+
+		// validation modes could be overridden by the vendor extensions of the spec
+		requestValidation, err := validationMode(route.Route, router.ExtRequestValidation, cfg.RequestValidation)
+		if err != nil {
+			return nil, fmt.Errorf("handler: %s %s: %w", route.Method, updRoutePath, err)
+		}
+
+		responseValidation, err := validationMode(route.Route, router.ExtResponseValidation, cfg.ResponseValidation)
+		if err != nil {
+			return nil, fmt.Errorf("handler: %s %s: %w", route.Method, updRoutePath, err)
+		}
+
+		// claims required by the operation
+		var requiredClaims woauth2.ClaimRequirements
+		if _, err := router.Extension(route.Route, router.ExtRequiredClaims, &requiredClaims); err != nil {
+			return nil, fmt.Errorf("handler: %s %s: %w", route.Method, updRoutePath, err)
+		}
+
+		// the required claims are checked only if the token is validated by each security requirement
+		if requiredClaims != nil && !requiresToken(route.Route) {
+			return nil, fmt.Errorf("handler: %s %s: %s require the oauth2 or openIdConnect scheme in each security requirement",
+				route.Method, updRoutePath, router.ExtRequiredClaims)
+		}
+
+		// path, query or body parameter bound to the claim of the token
+		owner, err := routeOwner(route.Route)
+		if err != nil {
+			return nil, fmt.Errorf("handler: %s %s: %w", route.Method, updRoutePath, err)
+		}
+
+		// role and claim based authorization rule
+		authz, err := routeAuthz(route.Route)
+		if err != nil {
+			return nil, fmt.Errorf("handler: %s %s: %w", route.Method, updRoutePath, err)
+		}
+
+		// the claims are available only if the token is validated by each security requirement
+		if (owner != nil || authz != nil) && !requiresToken(route.Route) {
+			return nil, fmt.Errorf("handler: %s %s: %s and %s require the oauth2 or openIdConnect scheme in each security requirement",
+				route.Method, updRoutePath, router.ExtOwner, router.ExtAuthz)
+		}
+
+		// client certificates allowlist of the mutualTLS security scheme
+		clientCerts, err := routeClientCerts(route.Route)
+		if err != nil {
+			return nil, fmt.Errorf("handler: %s %s: %w", route.Method, updRoutePath, err)
+		}
+
 		s := openapiWaf{
-			route:           route.Route,
-			proxyPool:       proxy,
-			pathParamLength: pathParamLength,
-			logger:          logger,
-			cfg:             cfg,
-			parserPool:      &parserPool,
-			oauthValidator:  oauthValidator,
+			route:              route.Route,
+			operation:          operation,
+			proxyPool:          proxy,
+			pathParamNames:     pathParamNames,
+			logger:             logger,
+			cfg:                cfg,
+			parserPool:         &parserPool,
+			oauthValidator:     opts.OAuthValidator,
+			oidcValidators:     oidcValidators,
+			credentials:        opts.Credentials,
+			apiKeys:            opts.APIKeys,
+			claimHeaders:       claimHeaders,
+			requestValidation:  requestValidation,
+			responseValidation: responseValidation,
+			requiredClaims:     requiredClaims,
+			owner:              owner,
+			authz:              authz,
+			clientCerts:        clientCerts,
+		}
+
+		var routeMiddlewares []web.Middleware
+
+		// IP allow and deny lists of the operation
+		routeIPFilter, err := routeIPFilter(route.Route, logger)
+		if err != nil {
+			return nil, fmt.Errorf("handler: %s %s: %w", route.Method, updRoutePath, err)
+		}
+
+		if routeIPFilter != nil {
+			routeMiddlewares = append(routeMiddlewares, mid.IPFilter(cfg, routeIPFilter, trustedProxies, logger))
+		}
+
+		// country and ASN rules of the operation
+		geoIPRules, err := routeGeoIPRules(route.Route, opts.GeoIP)
+		if err != nil {
+			return nil, fmt.Errorf("handler: %s %s: %w", route.Method, updRoutePath, err)
+		}
+
+		if geoIPRules != nil {
+			routeMiddlewares = append(routeMiddlewares, mid.GeoIP(cfg, opts.GeoIP, geoIPRules, trustedProxies, logger))
+		}
+
+		// rate limit of the operation
+		rateLimit, err := routeRateLimit(route.Route, &cfg.RateLimit)
+		if err != nil {
+			return nil, fmt.Errorf("handler: %s %s: %w", route.Method, updRoutePath, err)
+		}
+
+		if rateLimit != nil {
+			credentials := mid.RateLimitCredentials{APIKeys: opts.APIKeys, OAuth: routeTokenValidator(route.Route, opts.OAuthValidator, oidcValidators)}
+			routeMiddlewares = append(routeMiddlewares, mid.RateLimit(cfg, rateLimit, opts.RateLimiters, credentials, trustedProxies, operation, logger))
 		}
-		updRoutePath := path.Join(serverUrl.Path, route.Path)
 
 		s.logger.Debugf("handler: Loaded path : %s - %s", route.Method, updRoutePath)
 
-		app.Handle(route.Method, updRoutePath, s.openapiWafHandler)
+		app.Handle(route.Method, updRoutePath, s.openapiWafHandler, routeMiddlewares...)
 	}
 
 	// set handler for default behavior (404, 405)
 	s := openapiWaf{
-		route:           nil,
-		proxyPool:       proxy,
-		pathParamLength: 0,
-		logger:          logger,
-		cfg:             cfg,
-		parserPool:      &parserPool,
+		route:              nil,
+		proxyPool:          proxy,
+		logger:             logger,
+		cfg:                cfg,
+		parserPool:         &parserPool,
+		requestValidation:  cfg.RequestValidation,
+		responseValidation: cfg.ResponseValidation,
 	}
 	app.SetDefaultBehavior(s.openapiWafHandler)
 
-	return app.Router.Handler
+	return app.Router.Handler, nil
+}
+
+// validationMode returns the validation mode set by the vendor extension of
+// the route. The global validation mode is used if the extension is not set
+// or its value is invalid.
+func validationMode(route *routers.Route, extension string, global string) (string, error) {
+	var mode string
+
+	found, err := router.Extension(route, extension, &mode)
+	if err != nil || !found {
+		return global, err
+	}
+
+	switch mode {
+	case web.ValidationDisable, web.ValidationBlock, web.ValidationLog:
+		return mode, nil
+	}
+
+	return "", fmt.Errorf("%s: unsupported validation mode %q", extension, mode)
+}
+
+// routeTokenValidator returns the validator of the tokens of the route. The
+// provider of the openIdConnect scheme is used if the route is secured by it.
+func routeTokenValidator(route *routers.Route, oauthValidator woauth2.OAuth2, oidcValidators map[string]woauth2.OAuth2) woauth2.OAuth2 {
+	security := route.Swagger.Security
+	if route.Operation != nil && route.Operation.Security != nil {
+		security = *route.Operation.Security
+	}
+
+	for _, requirement := range security {
+		for name := range requirement {
+			scheme := route.Swagger.Components.SecuritySchemes[name]
+			if scheme == nil || scheme.Value == nil || scheme.Value.Type != "openIdConnect" {
+				continue
+			}
+			if validator, ok := oidcValidators[scheme.Value.OpenIdConnectUrl]; ok {
+				return validator
+			}
+		}
+	}
+
+	return oauthValidator
+}
+
+// rateLimitExtension is the value of the x-apifw-rate-limit extension
+type rateLimitExtension struct {
+	Rate   int    `json:"rate"`
+	Period string `json:"period"`
+	Burst  int    `json:"burst"`
+	Key    string `json:"key"`
+}
+
+// routeRateLimit returns the rate limit set by the vendor extension of the
+// route. Unset fields are inherited from the global rate limit. Each operation
+// has its own limit even if the extension is set at the spec root.
+func routeRateLimit(route *routers.Route, global *config.RateLimit) (*config.RateLimit, error) {
+	var ext rateLimitExtension
+
+	found, err := router.Extension(route, router.ExtRateLimit, &ext)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	if ext.Rate < 0 || ext.Burst < 0 {
+		return nil, fmt.Errorf("%s: rate and burst should be >= 0", router.ExtRateLimit)
+	}
+
+	rateLimit := *global
+
+	if ext.Rate > 0 {
+		rateLimit.Rate = ext.Rate
+	}
+	if ext.Burst > 0 {
+		rateLimit.Burst = ext.Burst
+	}
+
+	if ext.Period != "" {
+		period, err := time.ParseDuration(ext.Period)
+		if err != nil || period <= 0 {
+			return nil, fmt.Errorf("%s: invalid period %q", router.ExtRateLimit, ext.Period)
+		}
+		rateLimit.Period = period
+	}
+
+	if ext.Key != "" {
+		switch ext.Key {
+		case mid.RateLimitKeyIP, mid.RateLimitKeyAPIKey, mid.RateLimitKeySub, mid.RateLimitKeyOperation:
+			rateLimit.Key = ext.Key
+		default:
+			return nil, fmt.Errorf("%s: unsupported key %q", router.ExtRateLimit, ext.Key)
+		}
+	}
+
+	if rateLimit.Rate <= 0 {
+		return nil, fmt.Errorf("%s: rate should be > 0", router.ExtRateLimit)
+	}
+
+	return &rateLimit, nil
 }
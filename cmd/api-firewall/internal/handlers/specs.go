@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+	"github.com/wallarm/api-firewall/internal/config"
+	"github.com/wallarm/api-firewall/internal/platform/web"
+)
+
+// SpecHandler is the request handler of one of the API specs. The requests
+// are passed to the handler if they match the host and the path prefix.
+// Empty host or path prefix matches all requests.
+type SpecHandler struct {
+	Name       string
+	Host       string
+	PathPrefix string
+	Handler    fasthttp.RequestHandler
+}
+
+// matches checks the Host header (without port) and the path of the request.
+// The path prefix matches whole path segments only, so the /api prefix
+// matches /api and /api/users but not /apiv2.
+func (h *SpecHandler) matches(host, path []byte) bool {
+	if h.Host != "" && !strings.EqualFold(h.Host, string(host)) {
+		return false
+	}
+	if h.PathPrefix == "" {
+		return true
+	}
+
+	prefix := strings.TrimSuffix(h.PathPrefix, "/")
+	if !bytes.HasPrefix(path, []byte(prefix)) {
+		return false
+	}
+	return len(path) == len(prefix) || path[len(prefix)] == '/'
+}
+
+// SpecsRouter passes each request to the handler of the API spec selected by
+// the Host header and the path prefix. Specs with the host are checked
+// before specs without the host, longer path prefixes are checked before
+// shorter ones.
+func SpecsRouter(cfg *config.APIFWConfiguration, specs []SpecHandler, logger *logrus.Logger) fasthttp.RequestHandler {
+
+	ordered := make([]SpecHandler, len(specs))
+	copy(ordered, specs)
+
+	sort.SliceStable(ordered, func(i, j int) bool {
+		if (ordered[i].Host != "") != (ordered[j].Host != "") {
+			return ordered[i].Host != ""
+		}
+		return len(ordered[i].PathPrefix) > len(ordered[j].PathPrefix)
+	})
+
+	return func(ctx *fasthttp.RequestCtx) {
+		host := ctx.Host()
+		if i := bytes.LastIndexByte(host, ':'); i >= 0 && bytes.IndexByte(host[i:], ']') < 0 {
+			host = host[:i]
+		}
+
+		for i := range ordered {
+			if ordered[i].matches(host, ctx.Path()) {
+				ordered[i].Handler(ctx)
+				return
+			}
+		}
+
+		logger.Infof("#%016X: API spec not found: %s -> %s %s%s",
+			ctx.ID(),
+			ctx.RemoteAddr(),
+			ctx.Request.Header.Method(), ctx.Host(), ctx.Path(),
+		)
+		if err := web.RespondBlocked(ctx, cfg, fasthttp.StatusNotFound, "Not found", "API spec not found"); err != nil {
+			logger.Errorf("#%016X: Error while sending response: %v", ctx.ID(), err)
+		}
+	}
+}
@@ -19,9 +19,9 @@ import (
 	"github.com/wallarm/api-firewall/cmd/api-firewall/internal/handlers"
 	"github.com/wallarm/api-firewall/internal/config"
 	"github.com/wallarm/api-firewall/internal/platform/denylist"
-	"github.com/wallarm/api-firewall/internal/platform/openapi3"
+	"github.com/wallarm/api-firewall/internal/platform/metrics"
 	"github.com/wallarm/api-firewall/internal/platform/proxy"
-	"github.com/wallarm/api-firewall/internal/platform/router"
+	"github.com/wallarm/api-firewall/internal/platform/web"
 )
 
 var build = "develop"
@@ -141,74 +141,6 @@ func run(logger *logrus.Logger) error {
 	}
 	logger.Infof("%s: Configuration Loaded :\n%v\n", logPrefix, out)
 
-	// =========================================================================
-	// Init Swagger
-
-	var swagger *openapi3.Swagger
-
-	apiSpecUrl, err := url.ParseRequestURI(cfg.APISpecs)
-	if err != nil {
-		logger.Debugf("%s: Trying to parse API Spec value as URL : %v\n", logPrefix, err.Error())
-	}
-
-	switch apiSpecUrl {
-	case nil:
-		swagger, err = openapi3.NewSwaggerLoader().LoadSwaggerFromFile(cfg.APISpecs)
-		if err != nil {
-			return errors.Wrap(err, "loading swagwaf file")
-		}
-	default:
-		swagger, err = openapi3.NewSwaggerLoader().LoadSwaggerFromURI(apiSpecUrl)
-		if err != nil {
-			return errors.Wrap(err, "loading swagwaf url")
-		}
-	}
-
-	swagRouter, err := router.NewRouter(swagger)
-	if err != nil {
-		return errors.Wrap(err, "parsing swagwaf file")
-	}
-
-	// =========================================================================
-	// Init Proxy Client
-
-	serverUrl, err := url.ParseRequestURI(cfg.Server.URL)
-	if err != nil {
-		return errors.Wrap(err, "parsing proxy URL")
-	}
-	host := serverUrl.Host
-	if serverUrl.Port() == "" {
-		switch serverUrl.Scheme {
-		case "https":
-			host += ":443"
-		case "http":
-			host += ":80"
-		}
-	}
-
-	initialCap := 100
-
-	if cfg.Server.ClientPoolCapacity < 100 {
-		initialCap = 1
-	}
-
-	pool, err := proxy.NewChanPool(initialCap, cfg.Server.ClientPoolCapacity, host, &cfg.Server)
-	if err != nil {
-		return errors.Wrap(err, "proxy pool init")
-	}
-
-	// =========================================================================
-	// Init Cache
-
-	logger.Infof("%s: Initializing Cache", logPrefix)
-
-	deniedTokens, err := denylist.New(&cfg, logger)
-	if err != nil {
-		return errors.Wrap(err, "denylist init error")
-	}
-
-	logger.Infof("%s: Loaded %d tokens to the cache", logPrefix, deniedTokens.ElementsNum)
-
 	// =========================================================================
 	// Start API Service
 
@@ -233,25 +165,111 @@ func run(logger *logrus.Logger) error {
 	shutdown := make(chan os.Signal, 1)
 	signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM)
 
+	var apiHandler fasthttp.RequestHandler
+	healthData := handlers.Health{
+		Build:  build,
+		Logger: logger,
+	}
+	denylistAdmin := handlers.DenylistAdmin{
+		AdminToken: cfg.Denylist.AdminToken,
+		Logger:     logger,
+	}
+
+	switch cfg.APISpecsConfig {
+	case "":
+		defaultAPI, err := newAPI("default", &cfg, shutdown, logger)
+		if err != nil {
+			return err
+		}
+		defer defaultAPI.Close()
+
+		apiHandler = defaultAPI.handler.Handler
+		healthData.Pool = defaultAPI.pool
+		denylistAdmin.Tokens = defaultAPI.deniedTokens
+	default:
+		// several API specs are served by the single API service
+		apiSpecs, err := config.LoadAPISpecs(cfg.APISpecsConfig)
+		if err != nil {
+			return errors.Wrap(err, "loading API specs list")
+		}
+
+		if err := validate.Struct(apiSpecs); err != nil {
+			return errors.Wrap(err, "API specs list validation error")
+		}
+
+		var specHandlers []handlers.SpecHandler
+		healthData.SpecPools = make(map[string]proxy.Pool, len(apiSpecs.Specs))
+		denylistAdmin.SpecTokens = make(map[string]*denylist.DeniedTokens, len(apiSpecs.Specs))
+
+		for i := range apiSpecs.Specs {
+			spec := &apiSpecs.Specs[i]
+
+			logger.Infof("%s: %s: Initializing API spec %s (host: %q, path prefix: %q)", logPrefix, spec.Name, spec.APISpecs, spec.Host, spec.PathPrefix)
+
+			specCfg, err := spec.Configuration(&cfg)
+			if err != nil {
+				return err
+			}
+
+			specAPI, err := newAPI(spec.Name, specCfg, shutdown, logger)
+			if err != nil {
+				return errors.Wrapf(err, "API spec %s", spec.Name)
+			}
+			defer specAPI.Close()
+
+			specHandlers = append(specHandlers, handlers.SpecHandler{
+				Name:       spec.Name,
+				Host:       spec.Host,
+				PathPrefix: spec.PathPrefix,
+				Handler:    specAPI.handler.Handler,
+			})
+			healthData.SpecPools[spec.Name] = specAPI.pool
+			denylistAdmin.SpecTokens[spec.Name] = specAPI.deniedTokens
+		}
+
+		apiHandler = handlers.SpecsRouter(&cfg, specHandlers, logger)
+	}
+
 	api := fasthttp.Server{
-		Handler:               handlers.OpenapiProxy(&cfg, serverUrl, shutdown, logger, pool, swagRouter, deniedTokens),
+		Handler:               metrics.RequestHandler(apiHandler),
 		ReadTimeout:           cfg.ReadTimeout,
 		WriteTimeout:          cfg.WriteTimeout,
 		Logger:                logger,
 		NoDefaultServerHeader: true,
 	}
 
+	// client certificates are verified by the CA of the clients
+	if isTLS {
+		if api.TLSConfig, err = web.NewServerTLSConfig(&cfg.TLS); err != nil {
+			return errors.Wrap(err, "TLS configuration")
+		}
+	}
+
+	// HTTP/2 is served beside HTTP/1.1: negotiated by ALPN over TLS or by
+	// the connection preface over plaintext (h2c)
+	var apiHTTP2 *web.HTTP2Server
+	if cfg.HTTP2 {
+		if apiHTTP2, err = web.NewHTTP2Server(&api, logger); err != nil {
+			return errors.Wrap(err, "HTTP/2 configuration")
+		}
+	}
+
 	// Make a channel to listen for errors coming from the listener. Use a
 	// buffered channel so the goroutine can exit if we don't collect this error.
 	serverErrors := make(chan error, 1)
 
 	// Start the service listening for requests.
 	go func() {
-		logger.Infof("%s: API listening on %s", logPrefix, cfg.APIHost)
-		switch isTLS {
-		case false:
+		logger.Infof("%s: API listening on %s (HTTP/2: %t)", logPrefix, cfg.APIHost, cfg.HTTP2)
+		switch {
+		case !isTLS && apiHTTP2 != nil:
+			serverErrors <- apiHTTP2.ListenAndServe(apiHost.Host)
+		case isTLS && apiHTTP2 != nil:
+			serverErrors <- apiHTTP2.ListenAndServeTLS(apiHost.Host, path.Join(cfg.TLS.CertsPath, cfg.TLS.CertFile),
+				path.Join(cfg.TLS.CertsPath, cfg.TLS.CertKey))
+		case !isTLS:
 			serverErrors <- api.ListenAndServe(apiHost.Host)
-		case true:
+		default:
 			serverErrors <- api.ListenAndServeTLS(apiHost.Host, path.Join(cfg.TLS.CertsPath, cfg.TLS.CertFile),
 				path.Join(cfg.TLS.CertsPath, cfg.TLS.CertKey))
 		}
@@ -260,15 +278,13 @@ func run(logger *logrus.Logger) error {
 	// =========================================================================
 	// Start Health API Service
 
-	healthData := handlers.Health{
-		Build:  build,
-		Logger: logger,
-		Pool:   pool,
-	}
+	metricsHandler := metrics.Handler()
 
 	// health service handler
 	healthHandler := func(ctx *fasthttp.RequestCtx) {
 		switch string(ctx.Path()) {
+		case "/metrics":
+			metricsHandler(ctx)
 		case "/v1/liveness":
 			if err := healthData.Liveness(ctx); err != nil {
 				healthData.Logger.Errorf("%s: liveness: %s", logPrefix, err.Error())
@@ -277,6 +293,15 @@ func run(logger *logrus.Logger) error {
 			if err := healthData.Readiness(ctx); err != nil {
 				healthData.Logger.Errorf("%s: readiness: %s", logPrefix, err.Error())
 			}
+		case "/v1/denylist":
+			// the management API is disabled if the admin token is not set
+			if denylistAdmin.AdminToken == "" {
+				ctx.Error("Unsupported path", fasthttp.StatusNotFound)
+				return
+			}
+			if err := denylistAdmin.Handle(ctx); err != nil {
+				healthData.Logger.Errorf("%s: denylist: %s", logPrefix, err.Error())
+			}
 		default:
 			ctx.Error("Unsupported path", fasthttp.StatusNotFound)
 		}
@@ -308,13 +333,14 @@ func run(logger *logrus.Logger) error {
 		logger.Infof("%s: %v: Start shutdown", logPrefix, sig)
 
 		// Asking listener to shutdown and shed load.
-		if err := api.Shutdown(); err != nil {
+		shutdownAPI := api.Shutdown
+		if apiHTTP2 != nil {
+			shutdownAPI = apiHTTP2.Shutdown
+		}
+		if err := shutdownAPI(); err != nil {
 			return errors.Wrap(err, "could not stop server gracefully")
 		}
 		logger.Infof("%s: %v: Completed shutdown", logPrefix, sig)
-
-		// Close proxy pool
-		pool.Close()
 	}
 
 	return nil
@@ -7,38 +7,74 @@ import (
 )
 
 type TLS struct {
-	CertsPath string `conf:"default:certs"`
-	CertFile  string `conf:"default:localhost.crt"`
-	CertKey   string `conf:"default:localhost.key"`
+	CertsPath  string `conf:"default:certs"`
+	CertFile   string `conf:"default:localhost.crt"`
+	CertKey    string `conf:"default:localhost.key"`
+	ClientCA   string `conf:""`
+	ClientAuth string `conf:"default:NONE" validate:"oneof=NONE REQUEST REQUIRE"`
+}
+
+type HealthCheck struct {
+	Path     string        `conf:""`
+	Interval time.Duration `conf:"default:10s"`
+	Timeout  time.Duration `conf:"default:1s"`
 }
 
 type Server struct {
 	URL                string        `conf:"default:http://localhost:3000/v1/" validate:"required,url"`
+	Backends           []string      `conf:"" validate:"dive,url"`
+	BackendWeights     []int         `conf:""`
+	LoadBalancing      string        `conf:"default:ROUND_ROBIN" validate:"oneof=ROUND_ROBIN LEAST_CONN WEIGHTED"`
+	MaxFails           int           `conf:"default:3"`
+	FailTimeout        time.Duration `conf:"default:30s"`
+	HealthCheck        HealthCheck
 	ClientPoolCapacity int           `conf:"default:1000" validate:"gt=0"`
 	InsecureConnection bool          `conf:"default:false"`
 	RootCA             string        `conf:""`
+	ClientCert         string        `conf:""`
+	ClientKey          string        `conf:""`
+	CertUpdateInterval time.Duration `conf:"default:30s"`
+	ServerName         string        `conf:""`
+	MinTLSVersion      string        `conf:"default:1.2" validate:"oneof=1.0 1.1 1.2 1.3"`
+	CipherSuites       []string      `conf:""`
 	MaxConnsPerHost    int           `conf:"default:512"`
 	ReadTimeout        time.Duration `conf:"default:5s"`
 	WriteTimeout       time.Duration `conf:"default:5s"`
 	DialTimeout        time.Duration `conf:"default:200ms"`
+	HTTP2              bool          `conf:"default:false"`
 	Oauth              Oauth
+	BasicAuth          BasicAuth
+	APIKeys            APIKeys
 }
 
 type JWT struct {
-	SignatureAlgorithm string `conf:"default:RS256"`
-	PubCertFile        string `conf:""`
-	SecretKey          string `conf:""`
+	SignatureAlgorithm     string        `conf:"default:RS256"`
+	PubCertFile            string        `conf:""`
+	SecretKey              string        `conf:""`
+	JWKS                   string        `conf:""`
+	JWKSRefreshInterval    time.Duration `conf:"default:10m"`
+	JWKSMinRefreshInterval time.Duration `conf:"default:1m"`
+	Issuers                []string      `conf:""`
+	Audiences              []string      `conf:""`
+	Leeway                 time.Duration `conf:"default:0s"`
+	RequiredClaims         []string      `conf:""`
 }
 
 type Token struct {
-	CookieName       string `conf:""`
-	HeaderName       string `conf:""`
-	TrimBearerPrefix bool   `conf:"default:true"`
-	File             string `conf:""`
+	CookieName       string        `conf:""`
+	HeaderName       string        `conf:""`
+	QueryParamName   string        `conf:""`
+	BasicAuth        bool          `conf:"default:false"`
+	TrimBearerPrefix bool          `conf:"default:true"`
+	Claims           []string      `conf:"default:jti;sub;client_id"`
+	File             string        `conf:""`
+	UpdateInterval   time.Duration `conf:"default:30s"`
+	Persist          bool          `conf:"default:false"`
 }
 
 type Denylist struct {
-	Tokens Token
+	Tokens     Token
+	AdminToken string `conf:"noprint"`
 }
 
 type Introspection struct {
@@ -49,18 +85,72 @@ type Introspection struct {
 	ContentType           string        `conf:""`
 	EndpointMethod        string        `conf:"default:GET"`
 	RefreshInterval       time.Duration `conf:"default:10m"`
+	ClientIDs             []string      `conf:""`
+	ClientAuthMethod      string        `conf:"default:BEARER" validate:"oneof=BEARER CLIENT_SECRET_BASIC CLIENT_SECRET_POST"`
+	ClientID              string        `conf:""`
+	ClientSecret          string        `conf:"noprint"`
+	RootCA                string        `conf:""`
+	InsecureConnection    bool          `conf:"default:false"`
+	Timeout               time.Duration `conf:"default:5s"`
+	Retries               int           `conf:"default:2" validate:"gte=0"`
+	CacheSize             int64         `conf:"default:10000" validate:"gte=0"`
+}
+
+type BasicAuth struct {
+	HtpasswdFile   string        `conf:""`
+	UpdateInterval time.Duration `conf:"default:30s"`
+	CacheTTL       time.Duration `conf:"default:1m"`
+}
+
+type APIKeys struct {
+	File           string        `conf:""`
+	UpdateInterval time.Duration `conf:"default:30s"`
 }
 
 type Oauth struct {
-	ValidationType string `conf:"default:JWT"`
-	JWT            JWT
-	Introspection  Introspection
+	ValidationType            string `conf:"default:JWT"`
+	JWT                       JWT
+	Introspection             Introspection
+	ScopeClaims               []string `conf:"default:scope;scp"`
+	ClaimHeaders              []string `conf:""`
+	RemoveAuthorizationHeader bool     `conf:"default:false"`
 }
 
 type ShadowAPI struct {
 	ExcludeList []int `conf:"default:404,env:SHADOW_API_EXCLUDE_LIST" validate:"HttpStatusCodes"`
 }
 
+type RateLimit struct {
+	Rate         int           `conf:"default:0" validate:"gte=0"`
+	Period       time.Duration `conf:"default:1s" validate:"gt=0"`
+	Burst        int           `conf:"default:0" validate:"gte=0"`
+	Key          string        `conf:"default:IP" validate:"oneof=IP API_KEY SUB OPERATION"`
+	APIKeyHeader string        `conf:"default:X-API-Key"`
+	MaxKeys      int           `conf:"default:100000" validate:"gte=0"`
+}
+
+type IPList struct {
+	Entries []string `conf:"" validate:"dive,cidr|ip"`
+	File    string   `conf:""`
+}
+
+type IPFilter struct {
+	Allow          IPList
+	Deny           IPList
+	UpdateInterval time.Duration `conf:"default:30s"`
+}
+
+type GeoIP struct {
+	CountryDatabase string        `conf:""`
+	ASNDatabase     string        `conf:""`
+	UpdateInterval  time.Duration `conf:"default:1h"`
+	AllowCountries  []string      `conf:"" validate:"dive,len=2,alpha"`
+	DenyCountries   []string      `conf:"" validate:"dive,len=2,alpha"`
+	AllowASNs       []uint        `conf:""`
+	DenyASNs        []uint        `conf:""`
+	CountryHeader   string        `conf:""`
+}
+
 type APIFWConfiguration struct {
 	conf.Version
 	TLS    TLS
@@ -76,7 +166,16 @@ type APIFWConfiguration struct {
 	ResponseValidation        string        `conf:"required" validate:"required,oneof=DISABLE BLOCK LOG_ONLY"`
 	CustomBlockStatusCode     int           `conf:"default:403" validate:"HttpStatusCodes"`
 	AddValidationStatusHeader bool          `conf:"default:false"`
+	ProblemDetailsResponse    bool          `conf:"default:false"`
 	APISpecs                  string        `conf:"default:swagger.json,env:API_SPECS"`
+	APISpecsUpdateInterval    time.Duration `conf:"default:30s,env:API_SPECS_UPDATE_INTERVAL"`
+	APISpecsConfig            string        `conf:"env:API_SPECS_CONFIG"`
+	TrustedProxies            []string      `conf:"env:TRUSTED_PROXIES" validate:"dive,cidr|ip"`
+	ClientIPHeader            string        `conf:"default:X-Forwarded-For,env:CLIENT_IP_HEADER" validate:"oneof=X-Forwarded-For Forwarded"`
+	HTTP2                     bool          `conf:"default:false,env:HTTP2"`
 	ShadowAPI                 ShadowAPI
 	Denylist                  Denylist
+	RateLimit                 RateLimit
+	IPFilter                  IPFilter
+	GeoIP                     GeoIP
 }
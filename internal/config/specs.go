@@ -0,0 +1,96 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/ghodss/yaml"
+)
+
+// APISpec describes one of the API specs protected by the firewall. The
+// requests are passed to the API spec by the Host header and the path
+// prefix. Empty fields are inherited from the global configuration. The
+// denylist settings are merged with the global denylist settings, so only
+// the fields which are set in the API spec are overridden.
+type APISpec struct {
+	Name               string          `json:"name" validate:"required"`
+	APISpecs           string          `json:"apiSpecs" validate:"required"`
+	Host               string          `json:"host"`
+	PathPrefix         string          `json:"pathPrefix"`
+	ServerURL          string          `json:"serverUrl" validate:"omitempty,url"`
+	Backends           []string        `json:"backends" validate:"dive,url"`
+	BackendWeights     []int           `json:"backendWeights"`
+	RequestValidation  string          `json:"requestValidation" validate:"omitempty,oneof=DISABLE BLOCK LOG_ONLY"`
+	ResponseValidation string          `json:"responseValidation" validate:"omitempty,oneof=DISABLE BLOCK LOG_ONLY"`
+	Denylist           json.RawMessage `json:"denylist"`
+}
+
+type APISpecsList struct {
+	Specs []APISpec `json:"specs" validate:"required,dive"`
+}
+
+// LoadAPISpecs reads the list of the API specs from the YAML or JSON file
+func LoadAPISpecs(fileName string) (*APISpecsList, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	var specs APISpecsList
+	if err := yaml.Unmarshal(data, &specs); err != nil {
+		return nil, fmt.Errorf("parsing API specs list: %w", err)
+	}
+
+	names := make(map[string]struct{}, len(specs.Specs))
+	for _, spec := range specs.Specs {
+		if _, ok := names[spec.Name]; ok {
+			return nil, fmt.Errorf("API spec name %q is not unique", spec.Name)
+		}
+		names[spec.Name] = struct{}{}
+
+		if _, err := spec.Configuration(&APIFWConfiguration{}); err != nil {
+			return nil, err
+		}
+	}
+
+	return &specs, nil
+}
+
+// Configuration returns the copy of the global configuration with the
+// settings of the API spec applied
+func (s *APISpec) Configuration(global *APIFWConfiguration) (*APIFWConfiguration, error) {
+	cfg := *global
+
+	cfg.APISpecs = s.APISpecs
+
+	if s.ServerURL != "" {
+		cfg.Server.URL = s.ServerURL
+		cfg.Server.Backends = nil
+		cfg.Server.BackendWeights = nil
+	}
+
+	if len(s.Backends) > 0 {
+		cfg.Server.Backends = s.Backends
+		cfg.Server.BackendWeights = s.BackendWeights
+	}
+
+	if s.RequestValidation != "" {
+		cfg.RequestValidation = s.RequestValidation
+	}
+
+	if s.ResponseValidation != "" {
+		cfg.ResponseValidation = s.ResponseValidation
+	}
+
+	if len(s.Denylist) > 0 {
+		// the slice of the global configuration is not reused by the decoder
+		cfg.Denylist.Tokens.Claims = append([]string(nil), global.Denylist.Tokens.Claims...)
+
+		if err := json.Unmarshal(s.Denylist, &cfg.Denylist); err != nil {
+			return nil, fmt.Errorf("API spec %s: parsing denylist: %w", s.Name, err)
+		}
+	}
+
+	return &cfg, nil
+}
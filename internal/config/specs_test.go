@@ -0,0 +1,144 @@
+package config
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func writeSpecsFile(t *testing.T, data string) string {
+	t.Helper()
+
+	specsFile := t.TempDir() + "/specs.yaml"
+	if err := os.WriteFile(specsFile, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return specsFile
+}
+
+func TestLoadAPISpecs(t *testing.T) {
+
+	apiSpecs, err := LoadAPISpecs(writeSpecsFile(t, `
+specs:
+  - name: users
+    apiSpecs: /specs/users.yaml
+    pathPrefix: /users
+  - name: orders
+    apiSpecs: /specs/orders.yaml
+    host: orders.example.com
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(apiSpecs.Specs) != 2 || apiSpecs.Specs[0].PathPrefix != "/users" || apiSpecs.Specs[1].Host != "orders.example.com" {
+		t.Errorf("Incorrect API specs list: %+v", apiSpecs.Specs)
+	}
+
+	invalid := map[string]string{
+		"duplicate names": `
+specs:
+  - name: users
+    apiSpecs: /specs/users.yaml
+  - name: users
+    apiSpecs: /specs/orders.yaml
+`,
+		"malformed list": "specs: {",
+		"malformed denylist": `
+specs:
+  - name: users
+    apiSpecs: /specs/users.yaml
+    denylist:
+      tokens: [X-Token]
+`,
+	}
+
+	for name, data := range invalid {
+		if _, err := LoadAPISpecs(writeSpecsFile(t, data)); err == nil {
+			t.Errorf("%s: API specs list has been loaded", name)
+		}
+	}
+
+	if _, err := LoadAPISpecs(t.TempDir() + "/missing.yaml"); err == nil {
+		t.Error("Missing API specs list has been loaded")
+	}
+}
+
+func TestAPISpecConfiguration(t *testing.T) {
+
+	apiSpecs, err := LoadAPISpecs(writeSpecsFile(t, `
+specs:
+  - name: users
+    apiSpecs: /specs/users.yaml
+    serverUrl: http://users:8080
+    requestValidation: LOG_ONLY
+  - name: orders
+    apiSpecs: /specs/orders.yaml
+    backends:
+      - http://orders-1:8080
+      - http://orders-2:8080
+    backendWeights: [1, 2]
+    denylist:
+      tokens:
+        headerName: Authorization
+        claims: [sub]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	global := APIFWConfiguration{
+		APISpecs:           "/specs/default.yaml",
+		RequestValidation:  "BLOCK",
+		ResponseValidation: "BLOCK",
+		Denylist: Denylist{
+			Tokens: Token{
+				CookieName:       "session",
+				TrimBearerPrefix: true,
+				Claims:           []string{"jti", "sub", "client_id"},
+				UpdateInterval:   30 * time.Second,
+			},
+			AdminToken: "admin",
+		},
+	}
+	global.Server.URL = "http://default:8080"
+	global.Server.Backends = []string{"http://default-1:8080"}
+
+	users, err := apiSpecs.Specs[0].Configuration(&global)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if users.APISpecs != "/specs/users.yaml" || users.Server.URL != "http://users:8080" || len(users.Server.Backends) != 0 {
+		t.Errorf("Incorrect server of the users API spec: %s %s %v", users.APISpecs, users.Server.URL, users.Server.Backends)
+	}
+	if users.RequestValidation != "LOG_ONLY" || users.ResponseValidation != "BLOCK" {
+		t.Errorf("Incorrect validation modes of the users API spec: %s %s", users.RequestValidation, users.ResponseValidation)
+	}
+	if users.Denylist.Tokens.CookieName != "session" || len(users.Denylist.Tokens.Claims) != 3 {
+		t.Errorf("Denylist of the global configuration is not inherited: %+v", users.Denylist)
+	}
+
+	orders, err := apiSpecs.Specs[1].Configuration(&global)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if orders.Server.URL != "http://default:8080" || len(orders.Server.Backends) != 2 || len(orders.Server.BackendWeights) != 2 {
+		t.Errorf("Incorrect server of the orders API spec: %s %v %v", orders.Server.URL, orders.Server.Backends, orders.Server.BackendWeights)
+	}
+
+	// only the fields set in the API spec are overridden
+	tokens := orders.Denylist.Tokens
+	if tokens.HeaderName != "Authorization" || tokens.CookieName != "session" || !tokens.TrimBearerPrefix ||
+		tokens.UpdateInterval != 30*time.Second || len(tokens.Claims) != 1 || tokens.Claims[0] != "sub" ||
+		orders.Denylist.AdminToken != "admin" {
+		t.Errorf("Incorrect denylist of the orders API spec: %+v", orders.Denylist)
+	}
+
+	// the global configuration is not changed
+	if global.APISpecs != "/specs/default.yaml" || len(global.Server.Backends) != 1 || global.RequestValidation != "BLOCK" ||
+		global.Denylist.Tokens.HeaderName != "" || global.Denylist.Tokens.Claims[0] != "jti" {
+		t.Errorf("Global configuration has been changed: %+v", global)
+	}
+}
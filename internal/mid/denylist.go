@@ -6,7 +6,9 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/valyala/fasthttp"
 	"github.com/wallarm/api-firewall/internal/config"
+	"github.com/wallarm/api-firewall/internal/platform/basicauth"
 	"github.com/wallarm/api-firewall/internal/platform/denylist"
+	"github.com/wallarm/api-firewall/internal/platform/metrics"
 	"github.com/wallarm/api-firewall/internal/platform/web"
 )
 
@@ -19,14 +21,13 @@ func Denylist(cfg *config.APIFWConfiguration, deniedTokens *denylist.DeniedToken
 		// Create the handler that will be attached in the middleware chain.
 		h := func(ctx *fasthttp.RequestCtx) error {
 
-			// check existence and emptiness of the cache
-			if deniedTokens != nil && deniedTokens.ElementsNum > 0 {
-				//TODO: update getting token
+			// check existence of the denylist
+			if deniedTokens != nil {
 				if cfg.Denylist.Tokens.CookieName != "" {
 					token := string(ctx.Request.Header.Cookie(cfg.Denylist.Tokens.CookieName))
-					_, found := deniedTokens.Cache.Get(token)
-					if found {
-						return web.RespondError(ctx, cfg.CustomBlockStatusCode, nil)
+					if deniedTokens.Denied(token) {
+						metrics.DenylistBlocks.WithLabelValues("cookie").Inc()
+						return web.RespondBlocked(ctx, cfg, cfg.CustomBlockStatusCode, "Request blocked", "denied token in the cookie")
 					}
 				}
 				if cfg.Denylist.Tokens.HeaderName != "" {
@@ -34,9 +35,25 @@ func Denylist(cfg *config.APIFWConfiguration, deniedTokens *denylist.DeniedToken
 					if cfg.Denylist.Tokens.TrimBearerPrefix {
 						token = strings.TrimPrefix(token, "Bearer ")
 					}
-					_, found := deniedTokens.Cache.Get(token)
-					if found {
-						return web.RespondError(ctx, cfg.CustomBlockStatusCode, nil)
+					if deniedTokens.Denied(token) {
+						metrics.DenylistBlocks.WithLabelValues("header").Inc()
+						return web.RespondBlocked(ctx, cfg, cfg.CustomBlockStatusCode, "Request blocked", "denied token in the header")
+					}
+				}
+				if cfg.Denylist.Tokens.QueryParamName != "" {
+					token := string(ctx.QueryArgs().Peek(cfg.Denylist.Tokens.QueryParamName))
+					if deniedTokens.Denied(token) {
+						metrics.DenylistBlocks.WithLabelValues("query").Inc()
+						return web.RespondBlocked(ctx, cfg, cfg.CustomBlockStatusCode, "Request blocked", "denied token in the query")
+					}
+				}
+				// the token is either the username or the password of the
+				// Basic credentials
+				if cfg.Denylist.Tokens.BasicAuth {
+					username, password, err := basicauth.ParseHeader(string(ctx.Request.Header.Peek(fasthttp.HeaderAuthorization)))
+					if err == nil && (deniedTokens.Denied(username) || deniedTokens.Denied(password)) {
+						metrics.DenylistBlocks.WithLabelValues("basic").Inc()
+						return web.RespondBlocked(ctx, cfg, cfg.CustomBlockStatusCode, "Request blocked", "denied token in the basic credentials")
 					}
 				}
 			}
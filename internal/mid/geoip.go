@@ -0,0 +1,83 @@
+package mid
+
+import (
+	"net"
+
+	"github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+	"github.com/wallarm/api-firewall/internal/config"
+	"github.com/wallarm/api-firewall/internal/platform/geoip"
+	"github.com/wallarm/api-firewall/internal/platform/metrics"
+	"github.com/wallarm/api-firewall/internal/platform/web"
+)
+
+// locationLabel is the user value of the request with the location of the
+// client, so the client IP address is looked up once per request
+const locationLabel = "apifw_location"
+
+// GeoIP blocks requests of the clients which are denied by the country and
+// ASN rules. The client IP address is found behind the trusted proxies. The
+// country of the client is added to the logs and to the country header of the
+// upstream request if the header is configured. The rules may be nil.
+func GeoIP(cfg *config.APIFWConfiguration, db *geoip.Database, rules *geoip.Rules, trustedProxies []*net.IPNet, logger *logrus.Logger) web.Middleware {
+
+	// This is the actual middleware function to be executed.
+	m := func(before web.Handler) web.Handler {
+
+		// Create the handler that will be attached in the middleware chain.
+		h := func(ctx *fasthttp.RequestCtx) error {
+
+			location, clientIP := clientLocation(ctx, cfg, db, trustedProxies)
+
+			// the header is never passed from the client
+			if cfg.GeoIP.CountryHeader != "" {
+				ctx.Request.Header.Del(cfg.GeoIP.CountryHeader)
+				if location.Country != "" {
+					ctx.Request.Header.Set(cfg.GeoIP.CountryHeader, location.Country)
+				}
+			}
+
+			if rules != nil {
+				if rule := rules.Check(location); rule != "" {
+					metrics.GeoIPBlocks.WithLabelValues(rule).Inc()
+					logger.Infof("#%016X: client location is blocked by the %s rule: %s (country %q, ASN %d) -> %s %s",
+						ctx.ID(),
+						rule,
+						clientIP, location.Country, location.ASN,
+						ctx.Request.Header.Method(), ctx.Path(),
+					)
+
+					return web.RespondBlocked(ctx, cfg, cfg.CustomBlockStatusCode, "Request blocked", "client location is blocked by the "+rule+" rule")
+				}
+			}
+
+			err := before(ctx)
+
+			// Return the error, so it can be handled further up the chain.
+			return err
+		}
+
+		return h
+	}
+
+	return m
+}
+
+// clientLocation returns the location of the client IP address. The location
+// is looked up on the first call and is kept in the request.
+func clientLocation(ctx *fasthttp.RequestCtx, cfg *config.APIFWConfiguration, db *geoip.Database, trustedProxies []*net.IPNet) (geoip.Location, net.IP) {
+	clientIP := web.ClientIP(ctx, trustedProxies, cfg.ClientIPHeader)
+
+	if location, ok := ctx.UserValue(locationLabel).(geoip.Location); ok {
+		return location, clientIP
+	}
+
+	location := db.Lookup(clientIP)
+
+	ctx.SetUserValue(locationLabel, location)
+	if location.Country != "" {
+		ctx.SetUserValue(web.CountryLabel, location.Country)
+	}
+
+	return location, clientIP
+}
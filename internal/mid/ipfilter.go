@@ -0,0 +1,48 @@
+package mid
+
+import (
+	"net"
+
+	"github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+	"github.com/wallarm/api-firewall/internal/config"
+	"github.com/wallarm/api-firewall/internal/platform/ipfilter"
+	"github.com/wallarm/api-firewall/internal/platform/metrics"
+	"github.com/wallarm/api-firewall/internal/platform/web"
+)
+
+// IPFilter blocks requests of the clients which are denied by the IP filter.
+// The client IP address is found behind the trusted proxies.
+func IPFilter(cfg *config.APIFWConfiguration, filter *ipfilter.Filter, trustedProxies []*net.IPNet, logger *logrus.Logger) web.Middleware {
+
+	// This is the actual middleware function to be executed.
+	m := func(before web.Handler) web.Handler {
+
+		// Create the handler that will be attached in the middleware chain.
+		h := func(ctx *fasthttp.RequestCtx) error {
+
+			clientIP := web.ClientIP(ctx, trustedProxies, cfg.ClientIPHeader)
+
+			if list := filter.Check(clientIP); list != "" {
+				metrics.IPFilterBlocks.WithLabelValues(list).Inc()
+				logger.Infof("#%016X: IP address is blocked by the %s list: %s -> %s %s",
+					ctx.ID(),
+					list,
+					clientIP,
+					ctx.Request.Header.Method(), ctx.Path(),
+				)
+
+				return web.RespondBlocked(ctx, cfg, cfg.CustomBlockStatusCode, "Request blocked", "client IP address is blocked by the "+list+" list")
+			}
+
+			err := before(ctx)
+
+			// Return the error, so it can be handled further up the chain.
+			return err
+		}
+
+		return h
+	}
+
+	return m
+}
@@ -18,15 +18,23 @@ func Logger(logger *logrus.Logger) web.Middleware {
 
 		// Create the handler that will be attached in the middleware chain.
 		h := func(ctx *fasthttp.RequestCtx) error {
-			start := time.Now()
-
 			err := before(ctx)
 
-			logger.Infof("(%d) : #%016X : %s %s -> %s (%s)",
+			// client of the API key and country of the client IP address
+			var suffix string
+			if client, ok := ctx.UserValue(web.ClientLabel).(string); ok {
+				suffix += " : client " + client
+			}
+			if country, ok := ctx.UserValue(web.CountryLabel).(string); ok {
+				suffix += " : country " + country
+			}
+
+			logger.Infof("(%d) : #%016X : %s %s -> %s (%s)%s",
 				ctx.Response.StatusCode(),
 				ctx.ID(),
 				ctx.Request.Header.Method(), ctx.Path(),
-				ctx.RemoteAddr(), time.Since(start),
+				ctx.RemoteAddr(), time.Since(web.RequestTime(ctx)),
+				suffix,
 			)
 
 			// Return the error so it can be handled further up the chain.
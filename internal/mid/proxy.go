@@ -56,6 +56,9 @@ func Proxy(cfg *config.APIFWConfiguration, serverUrl *url.URL) web.Middleware {
 				ctx.Request.URI().SetHostBytes([]byte(serverUrl.Host))
 			}
 
+			// fields of the verified client certificate
+			web.SetClientCertHeaders(ctx)
+
 			// update or set x-forwarded-for header
 			switch xffValueb := ctx.Request.Header.Peek("X-Forwarded-For"); {
 			case xffValueb != nil:
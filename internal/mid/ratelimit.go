@@ -0,0 +1,130 @@
+package mid
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/fasthttp/router"
+	"github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+	"github.com/wallarm/api-firewall/internal/config"
+	"github.com/wallarm/api-firewall/internal/platform/apikeys"
+	"github.com/wallarm/api-firewall/internal/platform/metrics"
+	"github.com/wallarm/api-firewall/internal/platform/oauth2"
+	"github.com/wallarm/api-firewall/internal/platform/ratelimit"
+	"github.com/wallarm/api-firewall/internal/platform/web"
+)
+
+// Keys of the rate limits
+const (
+	RateLimitKeyIP        = "IP"
+	RateLimitKeyAPIKey    = "API_KEY"
+	RateLimitKeySub       = "SUB"
+	RateLimitKeyOperation = "OPERATION"
+)
+
+// RateLimitCredentials verify the API keys and the tokens used as the keys of
+// the API_KEY and SUB rate limits. The unverified credentials are not used as
+// the keys, so the limit can't be bypassed by the random keys or tokens.
+type RateLimitCredentials struct {
+	APIKeys *apikeys.Store
+	OAuth   oauth2.OAuth2
+}
+
+// RateLimit rejects requests which exceed the rate limit with the 429 status
+// code. The limiter of the operation is taken from the registry, so the
+// buckets survive the reload of the API spec. The operation is used as the key
+// of the OPERATION limit. If it is empty the method and the path of the
+// matched route are used.
+func RateLimit(cfg *config.APIFWConfiguration, rateLimit *config.RateLimit, limiters *ratelimit.Registry, credentials RateLimitCredentials, trustedProxies []*net.IPNet, operation string, logger *logrus.Logger) web.Middleware {
+
+	limiter := limiters.Limiter(operation, rateLimit.Rate, rateLimit.Period, rateLimit.Burst, rateLimit.MaxKeys)
+
+	// This is the actual middleware function to be executed.
+	m := func(before web.Handler) web.Handler {
+
+		// Create the handler that will be attached in the middleware chain.
+		h := func(ctx *fasthttp.RequestCtx) error {
+
+			if allowed, retryAfter := limiter.Allow(rateLimitKey(ctx, rateLimit, credentials, trustedProxies, cfg.ClientIPHeader, operation)); !allowed {
+				metrics.RateLimitRejections.WithLabelValues(strings.ToLower(rateLimit.Key)).Inc()
+				logger.Infof("#%016X: Rate limit exceeded: %s -> %s %s (key: %s)",
+					ctx.ID(),
+					ctx.RemoteAddr(),
+					ctx.Request.Header.Method(), ctx.Path(),
+					rateLimit.Key,
+				)
+
+				if err := web.RespondBlocked(ctx, cfg, fasthttp.StatusTooManyRequests, "Too many requests", "rate limit exceeded"); err != nil {
+					return err
+				}
+				ctx.Response.Header.Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+				return nil
+			}
+
+			err := before(ctx)
+
+			// Return the error, so it can be handled further up the chain.
+			return err
+		}
+
+		return h
+	}
+
+	return m
+}
+
+// rateLimitKey returns the key of the request bucket. The client IP is used if
+// the verified API key or the sub claim of the valid token is not found in
+// the request.
+func rateLimitKey(ctx *fasthttp.RequestCtx, cfg *config.RateLimit, credentials RateLimitCredentials, trustedProxies []*net.IPNet, clientIPHeader string, operation string) string {
+	switch cfg.Key {
+	case RateLimitKeyAPIKey:
+		if apiKey := ctx.Request.Header.Peek(cfg.APIKeyHeader); len(apiKey) > 0 && credentials.APIKeys != nil {
+			if key, ok := credentials.APIKeys.Lookup(string(apiKey)); ok {
+				return "key:" + key.Hash
+			}
+		}
+	case RateLimitKeySub:
+		if sub := tokenSubject(ctx, credentials.OAuth); sub != "" {
+			return "sub:" + sub
+		}
+	case RateLimitKeyOperation:
+		if operation != "" {
+			return "op:" + operation
+		}
+		routePath, ok := ctx.UserValue(router.MatchedRoutePathParam).(string)
+		if !ok {
+			routePath = "unknown"
+		}
+		return fmt.Sprintf("op:%s %s", ctx.Method(), routePath)
+	}
+
+	// the clients which can't be identified behind the trusted proxies share the bucket
+	clientIP := web.ClientIP(ctx, trustedProxies, clientIPHeader)
+	if clientIP == nil {
+		return "ip:unknown"
+	}
+
+	return "ip:" + clientIP.String()
+}
+
+// tokenSubject returns the sub claim of the bearer token. The token is
+// validated, so the subject can't be forged by the unsigned tokens.
+func tokenSubject(ctx *fasthttp.RequestCtx, validator oauth2.OAuth2) string {
+	authHeader := ctx.Request.Header.Peek("Authorization")
+	if validator == nil || len(authHeader) == 0 {
+		return ""
+	}
+
+	claims, err := validator.Validate(ctx, string(authHeader), nil)
+	if err != nil {
+		return ""
+	}
+
+	sub, _ := claims["sub"].(string)
+	return sub
+}
@@ -0,0 +1,176 @@
+package apikeys
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/sirupsen/logrus"
+
+	"github.com/wallarm/api-firewall/internal/config"
+	"github.com/wallarm/api-firewall/internal/platform/watcher"
+)
+
+const sha256Prefix = "sha256:"
+
+var (
+	ErrUnknownKey          = errors.New("unknown API key")
+	ErrKeyExpired          = errors.New("API key expired")
+	ErrOperationNotAllowed = errors.New("operation is not allowed for the API key")
+)
+
+// Key is the API key of the key store. Only the SHA-256 hash of the key is
+// stored. The key is allowed to call all operations if both operations and
+// tags are empty.
+type Key struct {
+	Hash       string     `json:"hash"`
+	Client     string     `json:"client"`
+	ExpiresAt  *time.Time `json:"expiresAt"`
+	Operations []string   `json:"operations"`
+	Tags       []string   `json:"tags"`
+}
+
+// allows checks that the operation or one of its tags is allowed for the key
+func (k *Key) allows(operation string, tags []string) bool {
+	if len(k.Operations) == 0 && len(k.Tags) == 0 {
+		return true
+	}
+
+	for _, allowed := range k.Operations {
+		if allowed == operation {
+			return true
+		}
+	}
+
+	for _, allowed := range k.Tags {
+		for _, tag := range tags {
+			if allowed == tag {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+type keysFile struct {
+	Keys []Key `json:"keys"`
+}
+
+// Store is the set of the API keys loaded from the YAML or JSON file
+type Store struct {
+	logger *logrus.Logger
+
+	mutex sync.RWMutex
+	keys  map[string]*Key
+
+	fileWatcher *watcher.Watcher
+}
+
+// New loads the key store and starts watching the file for changes, so the
+// revoked keys are rejected without restart. It returns nil if the key store
+// file is not configured.
+func New(cfg *config.APIKeys, logger *logrus.Logger) (*Store, error) {
+	if cfg.File == "" {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(cfg.File)
+	if err != nil {
+		return nil, err
+	}
+
+	store := Store{logger: logger}
+	if err := store.load(data); err != nil {
+		return nil, err
+	}
+
+	if cfg.UpdateInterval > 0 {
+		store.fileWatcher = watcher.New(cfg.File, cfg.UpdateInterval, func() ([]byte, error) {
+			return ioutil.ReadFile(cfg.File)
+		}, store.load, logger)
+		store.fileWatcher.Start(data)
+	}
+
+	return &store, nil
+}
+
+// load replaces the keys by the keys of the file
+func (s *Store) load(data []byte) error {
+	var file keysFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("API keys: %w", err)
+	}
+
+	keys := make(map[string]*Key, len(file.Keys))
+	for i := range file.Keys {
+		key := &file.Keys[i]
+
+		hash := strings.ToLower(strings.TrimPrefix(key.Hash, sha256Prefix))
+		if decoded, err := hex.DecodeString(hash); err != nil || len(decoded) != sha256.Size {
+			return fmt.Errorf("API keys: key %d of the client %q: hash should be the hex encoded SHA-256 of the key", i+1, key.Client)
+		}
+
+		keys[hash] = key
+	}
+
+	s.mutex.Lock()
+	s.keys = keys
+	s.mutex.Unlock()
+
+	s.logger.Infof("API keys: %d keys loaded", len(keys))
+
+	return nil
+}
+
+// Verify checks that the key exists, it is not expired and the operation is
+// allowed for the key. It returns the key of the store.
+func (s *Store) Verify(apiKey, operation string, tags []string) (*Key, error) {
+	key, found := s.find(apiKey)
+	if !found {
+		return nil, ErrUnknownKey
+	}
+
+	if key.ExpiresAt != nil && time.Now().After(*key.ExpiresAt) {
+		return key, ErrKeyExpired
+	}
+
+	if !key.allows(operation, tags) {
+		return key, ErrOperationNotAllowed
+	}
+
+	return key, nil
+}
+
+// Lookup returns the key of the store if it exists and it is not expired
+func (s *Store) Lookup(apiKey string) (*Key, bool) {
+	key, found := s.find(apiKey)
+	if !found || (key.ExpiresAt != nil && time.Now().After(*key.ExpiresAt)) {
+		return nil, false
+	}
+
+	return key, true
+}
+
+func (s *Store) find(apiKey string) (*Key, bool) {
+	sum := sha256.Sum256([]byte(apiKey))
+
+	s.mutex.RLock()
+	key, found := s.keys[hex.EncodeToString(sum[:])]
+	s.mutex.RUnlock()
+
+	return key, found
+}
+
+// Close stops watching the key store file
+func (s *Store) Close() {
+	if s.fileWatcher != nil {
+		s.fileWatcher.Stop()
+	}
+}
@@ -0,0 +1,162 @@
+package apikeys
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/wallarm/api-firewall/internal/config"
+)
+
+func keyHash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func newTestStore(t *testing.T, keys string) *Store {
+	t.Helper()
+
+	keysFile := t.TempDir() + "/apikeys.yaml"
+	if err := os.WriteFile(keysFile, []byte(keys), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := New(&config.APIKeys{File: keysFile}, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(store.Close)
+
+	return store
+}
+
+func TestLoad(t *testing.T) {
+
+	store := newTestStore(t, fmt.Sprintf(`
+keys:
+  - hash: %s
+    client: admin
+  - hash: sha256:%s
+    client: reports
+`, keyHash("admin-key"), keyHash("reports-key")))
+
+	if len(store.keys) != 2 {
+		t.Errorf("Incorrect number of the loaded keys. Expected: 2 and got %d", len(store.keys))
+	}
+
+	invalid := map[string]string{
+		"malformed file": "keys: [",
+		"plaintext key":  "keys:\n  - hash: admin-key\n",
+		"short hash":     "keys:\n  - hash: 0123abcd\n",
+		"invalid expiration": fmt.Sprintf("keys:\n  - hash: %s\n    expiresAt: tomorrow\n",
+			keyHash("admin-key")),
+	}
+
+	for name, data := range invalid {
+		if err := store.load([]byte(data)); err == nil {
+			t.Errorf("%s: key store has been loaded", name)
+		}
+	}
+
+	// the keys of the failed load are kept
+	if _, ok := store.Lookup("admin-key"); !ok {
+		t.Error("Keys are replaced by the invalid key store")
+	}
+}
+
+func TestVerify(t *testing.T) {
+
+	store := newTestStore(t, fmt.Sprintf(`
+keys:
+  - hash: %s
+    client: admin
+  - hash: %s
+    client: reports
+    tags: [reports]
+  - hash: %s
+    client: writer
+    operations: [postReports]
+  - hash: %s
+    client: expired
+    expiresAt: %s
+`, keyHash("admin-key"), keyHash("reports-key"), keyHash("writer-key"),
+		keyHash("expired-key"), time.Now().Add(-time.Hour).Format(time.RFC3339)))
+
+	testCases := []struct {
+		key       string
+		operation string
+		tags      []string
+		client    string
+		expected  error
+	}{
+		{"admin-key", "deleteReports", nil, "admin", nil},
+		{"reports-key", "getReports", []string{"public", "reports"}, "reports", nil},
+		{"reports-key", "getUsers", []string{"users"}, "reports", ErrOperationNotAllowed},
+		{"writer-key", "postReports", []string{"reports"}, "writer", nil},
+		{"writer-key", "getReports", []string{"reports"}, "writer", ErrOperationNotAllowed},
+		{"expired-key", "getReports", nil, "expired", ErrKeyExpired},
+		{"unknown-key", "getReports", nil, "", ErrUnknownKey},
+	}
+
+	for _, tc := range testCases {
+		key, err := store.Verify(tc.key, tc.operation, tc.tags)
+		if !errors.Is(err, tc.expected) {
+			t.Errorf("%s %s: unexpected result. Expected: %v and got %v", tc.key, tc.operation, tc.expected, err)
+		}
+
+		var client string
+		if key != nil {
+			client = key.Client
+		}
+		if client != tc.client {
+			t.Errorf("%s %s: incorrect client. Expected: %q and got %q", tc.key, tc.operation, tc.client, client)
+		}
+	}
+
+	// the expired and the unknown keys are not found
+	for key, found := range map[string]bool{"admin-key": true, "expired-key": false, "unknown-key": false} {
+		if _, ok := store.Lookup(key); ok != found {
+			t.Errorf("%s: incorrect lookup result. Expected: %t and got %t", key, found, ok)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+
+	keysFile := t.TempDir() + "/apikeys.yaml"
+	if err := os.WriteFile(keysFile, []byte(fmt.Sprintf("keys:\n  - hash: %s\n", keyHash("old-key"))), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := New(&config.APIKeys{File: keysFile, UpdateInterval: 20 * time.Millisecond}, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	// the revoked key is rejected without restart
+	if err := os.WriteFile(keysFile, []byte(fmt.Sprintf("keys:\n  - hash: %s\n", keyHash("new-key"))), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		if _, ok := store.Lookup("new-key"); ok {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if _, err := store.Verify("new-key", "getReports", nil); err != nil {
+		t.Errorf("New key is rejected after the reload: %v", err)
+	}
+
+	if _, err := store.Verify("old-key", "getReports", nil); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Revoked key is accepted after the reload: %v", err)
+	}
+}
@@ -0,0 +1,232 @@
+package basicauth
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/karlseguin/ccache/v2"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/wallarm/api-firewall/internal/config"
+	"github.com/wallarm/api-firewall/internal/platform/watcher"
+)
+
+const (
+	shaPrefix = "{SHA}"
+
+	// dummyHash is compared with the password of the unknown user, so the
+	// unknown and the known users can't be told apart by the response time
+	dummyHash = "$2a$10$9GOrrR8j4BTz0QaD2B3hCuTe4Eo2LC/DBBT2UwhX5B9w6vMgImLCq"
+
+	// maxCachedVerifications is the max number of the cached successful
+	// verifications
+	maxCachedVerifications = 10000
+)
+
+var (
+	ErrInvalidCredentials  = errors.New("invalid basic auth credentials")
+	ErrOperationNotAllowed = errors.New("operation is not allowed for the user")
+)
+
+type user struct {
+	hash string
+
+	// operations allowed for the user, all operations are allowed if empty
+	operations map[string]struct{}
+}
+
+// Credentials is the store of the users loaded from the htpasswd file. Each
+// line of the file is "user:hash" with the bcrypt or {SHA} hash of the
+// password. The optional third field is the comma separated list of the
+// operations (operationId or "METHOD /path") allowed for the user.
+type Credentials struct {
+	logger *logrus.Logger
+
+	mutex sync.RWMutex
+	users map[string]user
+
+	// verified caches the successful password checks for the cache TTL, so
+	// the bcrypt hash is not computed on each request
+	verified *ccache.Cache
+	cacheTTL time.Duration
+
+	fileWatcher *watcher.Watcher
+}
+
+// New loads the htpasswd file and starts watching it for changes. It returns
+// nil if the htpasswd file is not configured.
+func New(cfg *config.BasicAuth, logger *logrus.Logger) (*Credentials, error) {
+	if cfg.HtpasswdFile == "" {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(cfg.HtpasswdFile)
+	if err != nil {
+		return nil, err
+	}
+
+	credentials := Credentials{logger: logger, cacheTTL: cfg.CacheTTL}
+	if cfg.CacheTTL > 0 {
+		credentials.verified = ccache.New(ccache.Configure().MaxSize(maxCachedVerifications))
+	}
+
+	if err := credentials.load(data); err != nil {
+		return nil, err
+	}
+
+	if cfg.UpdateInterval > 0 {
+		credentials.fileWatcher = watcher.New(cfg.HtpasswdFile, cfg.UpdateInterval, func() ([]byte, error) {
+			return ioutil.ReadFile(cfg.HtpasswdFile)
+		}, credentials.load, logger)
+		credentials.fileWatcher.Start(data)
+	}
+
+	return &credentials, nil
+}
+
+// load replaces the users by the users of the htpasswd file
+func (c *Credentials) load(data []byte) error {
+	users := make(map[string]user)
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) < 2 || fields[0] == "" {
+			return fmt.Errorf("htpasswd: line %d: invalid format", lineNum)
+		}
+
+		hash := fields[1]
+		if !isBcrypt(hash) && !strings.HasPrefix(hash, shaPrefix) {
+			return fmt.Errorf("htpasswd: line %d: unsupported hash of the user %s, only bcrypt and {SHA} are supported", lineNum, fields[0])
+		}
+
+		u := user{hash: hash}
+		if len(fields) == 3 && fields[2] != "" {
+			u.operations = make(map[string]struct{})
+			for _, operation := range strings.Split(fields[2], ",") {
+				u.operations[strings.TrimSpace(operation)] = struct{}{}
+			}
+		}
+
+		users[fields[0]] = u
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	c.users = users
+	c.mutex.Unlock()
+
+	c.logger.Infof("htpasswd: %d users loaded", len(users))
+
+	return nil
+}
+
+func isBcrypt(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+// Verify checks the password of the user and that the operation is allowed for the user
+func (c *Credentials) Verify(username, password, operation string) error {
+	c.mutex.RLock()
+	u, found := c.users[username]
+	c.mutex.RUnlock()
+
+	if !found {
+		bcrypt.CompareHashAndPassword([]byte(dummyHash), []byte(password))
+		return ErrInvalidCredentials
+	}
+
+	if !c.checkPassword(username, password, u.hash) {
+		return ErrInvalidCredentials
+	}
+
+	if u.operations != nil {
+		if _, ok := u.operations[operation]; !ok {
+			return ErrOperationNotAllowed
+		}
+	}
+
+	return nil
+}
+
+// checkPassword compares the password with the hash of the user. The
+// successful checks are cached by the username, the hash and the password,
+// so the changed password of the reloaded htpasswd file is checked again.
+func (c *Credentials) checkPassword(username, password, hash string) bool {
+	var key string
+	if c.verified != nil {
+		sum := sha256.Sum256([]byte(username + "\x00" + hash + "\x00" + password))
+		key = hex.EncodeToString(sum[:])
+		if item := c.verified.Get(key); item != nil && !item.Expired() {
+			return true
+		}
+	}
+
+	switch {
+	case isBcrypt(hash):
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+			return false
+		}
+	default:
+		sum := sha1.Sum([]byte(password))
+		expected := shaPrefix + base64.StdEncoding.EncodeToString(sum[:])
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(hash)) != 1 {
+			return false
+		}
+	}
+
+	if c.verified != nil {
+		c.verified.Set(key, struct{}{}, c.cacheTTL)
+	}
+
+	return true
+}
+
+// ParseHeader decodes the username and the password of the Authorization header
+func ParseHeader(header string) (string, string, error) {
+	if len(header) < 6 || !strings.EqualFold(header[:6], "basic ") {
+		return "", "", errors.New("missing basic authorization header")
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(header[6:]))
+	if err != nil {
+		return "", "", errors.New("malformed basic authorization header")
+	}
+
+	i := bytes.IndexByte(decoded, ':')
+	if i < 0 {
+		return "", "", errors.New("malformed basic authorization header")
+	}
+
+	return string(decoded[:i]), string(decoded[i+1:]), nil
+}
+
+// Close stops watching the htpasswd file and the cache of the verifications
+func (c *Credentials) Close() {
+	if c.fileWatcher != nil {
+		c.fileWatcher.Stop()
+	}
+	if c.verified != nil {
+		c.verified.Stop()
+	}
+}
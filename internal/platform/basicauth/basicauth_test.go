@@ -0,0 +1,183 @@
+package basicauth
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/wallarm/api-firewall/internal/config"
+)
+
+func bcryptHash(t *testing.T, password string) string {
+	t.Helper()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(hash)
+}
+
+func shaHash(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return shaPrefix + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func newTestCredentials(t *testing.T, htpasswd string) *Credentials {
+	t.Helper()
+
+	htpasswdFile := t.TempDir() + "/htpasswd"
+	if err := os.WriteFile(htpasswdFile, []byte(htpasswd), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	credentials, err := New(&config.BasicAuth{HtpasswdFile: htpasswdFile, CacheTTL: time.Minute}, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(credentials.Close)
+
+	return credentials
+}
+
+func TestLoad(t *testing.T) {
+
+	credentials := newTestCredentials(t, "")
+
+	htpasswd := fmt.Sprintf(`
+# comment
+admin:%s
+reader:%s:getUsers, GET /users/{id}
+`, bcryptHash(t, "admin-password"), shaHash("reader-password"))
+
+	if err := credentials.load([]byte(htpasswd)); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(credentials.users) != 2 {
+		t.Fatalf("Incorrect number of the loaded users. Expected: 2 and got %d", len(credentials.users))
+	}
+
+	if credentials.users["admin"].operations != nil {
+		t.Errorf("Operations of the admin are restricted: %v", credentials.users["admin"].operations)
+	}
+
+	operations := credentials.users["reader"].operations
+	if _, ok := operations["GET /users/{id}"]; !ok || len(operations) != 2 {
+		t.Errorf("Incorrect operations of the reader: %v", operations)
+	}
+
+	invalid := map[string]string{
+		"missing hash":     "admin\n",
+		"empty username":   ":" + shaHash("password") + "\n",
+		"unsupported hash": "admin:$apr1$salt$hash\n",
+		"plain password":   "admin:password\n",
+	}
+
+	for name, data := range invalid {
+		if err := credentials.load([]byte(data)); err == nil {
+			t.Errorf("%s: htpasswd file has been loaded", name)
+		}
+	}
+
+	// the users of the failed load are kept
+	if len(credentials.users) != 2 {
+		t.Errorf("Users are replaced by the invalid htpasswd file: %d users", len(credentials.users))
+	}
+}
+
+func TestVerify(t *testing.T) {
+
+	credentials := newTestCredentials(t, fmt.Sprintf("admin:%s\nreader:%s:getUsers\n",
+		bcryptHash(t, "admin-password"), shaHash("reader-password")))
+
+	testCases := []struct {
+		username  string
+		password  string
+		operation string
+		expected  error
+	}{
+		{"admin", "admin-password", "deleteUser", nil},
+		{"admin", "reader-password", "getUsers", ErrInvalidCredentials},
+		{"reader", "reader-password", "getUsers", nil},
+		{"reader", "reader-password", "deleteUser", ErrOperationNotAllowed},
+		{"reader", "admin-password", "getUsers", ErrInvalidCredentials},
+		{"unknown", "admin-password", "getUsers", ErrInvalidCredentials},
+		{"", "", "getUsers", ErrInvalidCredentials},
+	}
+
+	for _, tc := range testCases {
+		// the second check is served by the cache of the verifications
+		for i := 0; i < 2; i++ {
+			if err := credentials.Verify(tc.username, tc.password, tc.operation); !errors.Is(err, tc.expected) {
+				t.Errorf("%s:%s %s: unexpected result. Expected: %v and got %v", tc.username, tc.password, tc.operation, tc.expected, err)
+			}
+		}
+	}
+
+	// the password of the unknown user is compared with the dummy bcrypt hash
+	start := time.Now()
+	if err := credentials.Verify("unknown", "admin-password", ""); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("Incorrect verification result of the unknown user: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 5*time.Millisecond {
+		t.Errorf("Unknown user is verified without the password comparison in %s", elapsed)
+	}
+}
+
+func TestVerifyReload(t *testing.T) {
+
+	credentials := newTestCredentials(t, "admin:"+bcryptHash(t, "old-password")+"\n")
+
+	if err := credentials.Verify("admin", "old-password", ""); err != nil {
+		t.Fatalf("Verification of the password failed: %s", err)
+	}
+
+	// the cached verification of the old password is not used after the hash is changed
+	if err := credentials.load([]byte("admin:" + bcryptHash(t, "new-password") + "\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := credentials.Verify("admin", "old-password", ""); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("Old password is accepted after the reload: %v", err)
+	}
+
+	if err := credentials.Verify("admin", "new-password", ""); err != nil {
+		t.Errorf("Verification of the new password failed: %s", err)
+	}
+
+	// the removed user is rejected
+	if err := credentials.load([]byte("reader:" + shaHash("reader-password") + "\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := credentials.Verify("admin", "new-password", ""); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("Removed user is accepted after the reload: %v", err)
+	}
+}
+
+func TestParseHeader(t *testing.T) {
+
+	username, password, err := ParseHeader("Basic " + base64.StdEncoding.EncodeToString([]byte("admin:pass:word")))
+	if err != nil || username != "admin" || password != "pass:word" {
+		t.Errorf("Incorrect credentials of the header: %q %q %v", username, password, err)
+	}
+
+	for _, header := range []string{
+		"",
+		"Bearer token",
+		"Basic !!!",
+		"Basic " + base64.StdEncoding.EncodeToString([]byte("admin")),
+	} {
+		if _, _, err := ParseHeader(header); err == nil {
+			t.Errorf("Malformed header %q has been parsed", header)
+		}
+	}
+}
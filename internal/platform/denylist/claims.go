@@ -0,0 +1,34 @@
+package denylist
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+
+	"github.com/wallarm/api-firewall/internal/platform/oauth2"
+)
+
+// unverifiedClaims decodes the payload of the JWT without the signature
+// verification. It returns false if the token is not a JWT.
+func unverifiedClaims(token string) (oauth2.Claims, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, false
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, false
+	}
+
+	var claims oauth2.Claims
+
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	if err := decoder.Decode(&claims); err != nil {
+		return nil, false
+	}
+
+	return claims, true
+}
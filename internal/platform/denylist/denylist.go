@@ -2,104 +2,560 @@ package denylist
 
 import (
 	"bufio"
-	"io"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
-	"github.com/dgraph-io/ristretto"
 	"github.com/sirupsen/logrus"
 	"github.com/wallarm/api-firewall/internal/config"
+	"github.com/wallarm/api-firewall/internal/platform/watcher"
 )
 
-const (
-	BufferItems = 64
-	ElementCost = 1
-)
+// DigestPrefix is the prefix of the SHA-256 digests of the denylist entries
+const DigestPrefix = "sha256:"
+
+// digestLineLen is the length of the line of the digest in the file
+const digestLineLen = len(DigestPrefix) + 2*len(digest{}) + 1
+
+var ErrInvalidToken = errors.New("invalid token")
 
+// Entry is the digest of the denied token or claim
+type Entry struct {
+	Digest    string     `json:"digest"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// DeniedTokens is the set of the denied tokens and JWT claims loaded from
+// the file. Only the SHA-256 digests of the entries are stored. The file
+// lines are either the digests with the sha256: prefix, the claims in the
+// claim:value format (e.g. jti:6f1c) or the plaintext tokens. The entry is
+// optionally followed by the expiration time (RFC 3339 or unix time), so it
+// drops out of the denylist once the token is expired anyway.
+//
+// The file is watched for changes and only the difference between the
+// versions of the file is applied, so the entries added or removed at
+// runtime are kept. The runtime changes are optionally written back to the
+// file.
 type DeniedTokens struct {
-	Cache       *ristretto.Cache
-	ElementsNum int64
+	file    string
+	persist bool
+	claims  []string
+	logger  *logrus.Logger
+
+	// updateMutex serializes the reloads and the runtime changes, so the
+	// file is read and written without blocking the lookups
+	updateMutex sync.Mutex
+
+	// the entries added at runtime override the entries of the file
+	mutex   sync.RWMutex
+	fileSet *digestSet
+	added   map[digest]int64
+	removed map[digest]struct{}
+
+	fileWatcher *watcher.Watcher
 }
 
+// New loads the denied tokens and starts watching the file. It returns nil
+// if the denylist file is not configured.
 func New(cfg *config.APIFWConfiguration, logger *logrus.Logger) (*DeniedTokens, error) {
 
 	if cfg.Denylist.Tokens.File == "" {
 		return nil, nil
 	}
 
-	var totalEntries int64
-	var totalCacheCapacity int64
+	deniedTokens := DeniedTokens{
+		file:    cfg.Denylist.Tokens.File,
+		persist: cfg.Denylist.Tokens.Persist,
+		claims:  cfg.Denylist.Tokens.Claims,
+		logger:  logger,
+		added:   make(map[digest]int64),
+		removed: make(map[digest]struct{}),
+	}
 
-	// open tokens storage
-	f, err := os.Open(cfg.Denylist.Tokens.File)
+	fileSet, err := deniedTokens.readFile()
 	if err != nil {
 		return nil, err
 	}
+	deniedTokens.fileSet = fileSet
 
-	// count non-empty entries and total cache capacity in bytes
-	c := bufio.NewScanner(f)
-	for c.Scan() {
-		if c.Text() != "" {
-			totalCacheCapacity += int64(len(c.Text()))
-			totalEntries += 1
+	if cfg.Denylist.Tokens.UpdateInterval > 0 {
+		signature, err := fileSignature(cfg.Denylist.Tokens.File)
+		if err != nil {
+			return nil, err
 		}
+
+		deniedTokens.fileWatcher = watcher.New(cfg.Denylist.Tokens.File, cfg.Denylist.Tokens.UpdateInterval, func() ([]byte, error) {
+			return fileSignature(cfg.Denylist.Tokens.File)
+		}, deniedTokens.load, logger)
+		deniedTokens.fileWatcher.Start(signature)
 	}
-	err = c.Err()
+
+	return &deniedTokens, nil
+}
+
+// fileSignature returns the size and the modification time of the file. The
+// file may contain millions of entries, so the watcher compares the
+// signatures instead of the content.
+func fileSignature(file string) ([]byte, error) {
+	info, err := os.Stat(file)
 	if err != nil {
 		return nil, err
 	}
 
-	// go to the beginning of the storage file
-	if _, err = f.Seek(0, io.SeekStart); err != nil {
-		return nil, err
+	return []byte(fmt.Sprintf("%d %d", info.Size(), info.ModTime().UnixNano())), nil
+}
+
+// parseEntry returns the digest of the denylist entry. The claim entries are
+// hashed as is, so they match the digests of the claims of the token.
+func (d *DeniedTokens) parseEntry(entry string) (digest, bool, error) {
+	var key digest
+
+	if !strings.HasPrefix(entry, DigestPrefix) {
+		return tokenDigest(entry), !d.isClaimEntry(entry), nil
 	}
 
-	logger.Debugf("Denylist: total entries (lines) found in the file: %d", totalEntries)
+	decoded, err := hex.DecodeString(entry[len(DigestPrefix):])
+	if err != nil || len(decoded) != len(key) {
+		return key, false, fmt.Errorf("%w: %s entry should be the hex encoded SHA-256", ErrInvalidToken, DigestPrefix)
+	}
+	copy(key[:], decoded)
 
-	// max cost = total bytes found in the storage + 5%
-	maxCost := totalCacheCapacity + totalCacheCapacity/20
+	return key, false, nil
+}
 
-	logger.Debugf("Denylist: cache capacity: %d bytes", maxCost)
+func (d *DeniedTokens) isClaimEntry(entry string) bool {
+	for _, claim := range d.claims {
+		if strings.HasPrefix(entry, claim+":") {
+			return true
+		}
+	}
+	return false
+}
 
-	cache, err := ristretto.NewCache(&ristretto.Config{
-		NumCounters: maxCost * 10, // recommended value
-		MaxCost:     maxCost,
-		BufferItems: BufferItems,
-	})
+// parseExpiration parses the expiration time in the RFC 3339 or the unix
+// time format
+func parseExpiration(value string) (int64, error) {
+	if unix, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return unix, nil
+	}
+
+	expiresAt, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return 0, fmt.Errorf("%w: expiration time should be in RFC 3339 or unix time format", ErrInvalidToken)
+	}
+
+	return expiresAt.Unix(), nil
+}
+
+// readFile reads the digests of the entries of the file. The memory is
+// preallocated by the file size, so the digests of the file of the 10M
+// digests take 320MB.
+func (d *DeniedTokens) readFile() (*digestSet, error) {
+	f, err := os.Open(d.file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
 	if err != nil {
 		return nil, err
 	}
 
-	var numOfElements int64
-	totalEntries10P := totalEntries / 10
+	digests := make([]digest, 0, info.Size()/int64(digestLineLen)+1)
+	expires := make(map[digest]int64)
 
-	// 10% counter
-	counter10P := 0
+	var line, plaintext int
 
-	// tokens loading to the cache
 	s := bufio.NewScanner(f)
 	for s.Scan() {
-		if s.Text() != "" {
-			if ok := cache.Set(strings.TrimSpace(s.Text()), nil, ElementCost); ok {
-				numOfElements += 1
-				if numOfElements%totalEntries10P == 0 {
-					counter10P += 10
-					logger.Debugf("Denylist: loaded %d perecents of tokens. Total elements in the cache: %d", counter10P, numOfElements)
-				}
-			} else {
-				logger.Errorf("Denylist: can't add the token to the cache: %s", s.Text())
+		line++
+
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("denylist: line %d: %w: entry should be followed by the expiration time only", line, ErrInvalidToken)
+		}
+
+		key, isPlaintext, err := d.parseEntry(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("denylist: line %d: %w", line, err)
+		}
+		if isPlaintext {
+			plaintext++
+		}
+
+		// the latest expiration time of the duplicates is kept
+		if len(fields) == 2 {
+			expiration, err := parseExpiration(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("denylist: line %d: %w", line, err)
+			}
+			if expiration > expires[key] {
+				expires[key] = expiration
 			}
-			cache.Wait()
 		}
+
+		digests = append(digests, key)
 	}
-	err = s.Err()
-	if err != nil {
+	if err := s.Err(); err != nil {
 		return nil, err
 	}
 
+	if plaintext > 0 {
+		d.logger.Warnf("Denylist: %d plaintext tokens found in the file, store the %s digests of the tokens instead", plaintext, DigestPrefix)
+	}
+
+	fileSet := newDigestSet(digests, expires)
+
+	d.logger.Debugf("Denylist: total entries found in the file: %d", fileSet.len())
+
+	return fileSet, nil
+}
+
+// load applies the difference between the new and the previous versions of
+// the file. The watched data is the file signature, the file is read again.
+func (d *DeniedTokens) load([]byte) error {
+	d.updateMutex.Lock()
+	defer d.updateMutex.Unlock()
+
+	fileSet, err := d.readFile()
+	if err != nil {
+		return err
+	}
+
+	added, removed := d.fileSet.diff(fileSet)
+
+	d.mutex.Lock()
+
+	// the runtime changes already made by the new version of the file are
+	// not kept
+	for key, expiration := range d.added {
+		if fileSet.contains(&key) && fileSet.expiration(&key) == expiration {
+			delete(d.added, key)
+		}
+	}
+	for key := range d.removed {
+		if !fileSet.contains(&key) {
+			delete(d.removed, key)
+		}
+	}
+
+	d.fileSet = fileSet
+
+	d.mutex.Unlock()
+
+	d.logger.Infof("Denylist: %d entries added, %d entries removed, total entries: %d", added, removed, d.Len())
+
+	return nil
+}
+
+// lookup returns the expiration time of the entry. The expired entries are
+// not found.
+func (d *DeniedTokens) lookup(key *digest, now int64) (int64, bool) {
+	if _, found := d.removed[*key]; found {
+		return 0, false
+	}
+
+	expiration, found := d.added[*key]
+	if !found {
+		if !d.fileSet.contains(key) {
+			return 0, false
+		}
+		expiration = d.fileSet.expiration(key)
+	}
+
+	return expiration, !expired(expiration, now)
+}
+
+// Contains checks that the token is denied
+func (d *DeniedTokens) Contains(token string) bool {
+	if token == "" {
+		return false
+	}
+
+	key := tokenDigest(token)
+
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	_, found := d.lookup(&key, time.Now().Unix())
+	return found
+}
+
+// Denied checks that the token or one of the configured claims of the JWT is
+// denied. The claims are read without the signature verification: the
+// forged token is denied at most.
+func (d *DeniedTokens) Denied(token string) bool {
+	if d.Contains(token) {
+		return true
+	}
+
+	if len(d.claims) == 0 {
+		return false
+	}
+
+	claims, ok := unverifiedClaims(token)
+	if !ok {
+		return false
+	}
+
+	for _, claim := range d.claims {
+		for _, value := range claims.Values(claim) {
+			if d.Contains(claim + ":" + value) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Len returns the number of the denylist entries
+func (d *DeniedTokens) Len() int {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	total := d.fileSet.len() - len(d.removed)
+	for key := range d.added {
+		if !d.fileSet.contains(&key) {
+			total++
+		}
+	}
+
+	return total
+}
+
+type record struct {
+	key        digest
+	expiration int64
+}
+
+// records returns the sorted entries of the denylist that are not expired
+func (d *DeniedTokens) records() []record {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	now := time.Now().Unix()
+
+	records := make([]record, 0, d.fileSet.len()+len(d.added))
+	for i := range d.fileSet.digests {
+		key := &d.fileSet.digests[i]
+		if _, found := d.added[*key]; found {
+			continue
+		}
+		if expiration, found := d.lookup(key, now); found {
+			records = append(records, record{key: *key, expiration: expiration})
+		}
+	}
+	for key, expiration := range d.added {
+		if !expired(expiration, now) {
+			records = append(records, record{key: key, expiration: expiration})
+		}
+	}
+
+	if len(d.added) > 0 {
+		sort.Slice(records, func(i, j int) bool {
+			return bytes.Compare(records[i].key[:], records[j].key[:]) < 0
+		})
+	}
+
+	return records
+}
+
+// List returns the sorted entries of the denylist that are not expired
+func (d *DeniedTokens) List() []Entry {
+	records := d.records()
+
+	entries := make([]Entry, len(records))
+	for i := range records {
+		entries[i].Digest = DigestPrefix + hex.EncodeToString(records[i].key[:])
+		if records[i].expiration != 0 {
+			expiresAt := time.Unix(records[i].expiration, 0).UTC()
+			entries[i].ExpiresAt = &expiresAt
+		}
+	}
+
+	return entries
+}
+
+// Add adds the tokens, the claims in the claim:value format or the digests
+// with the sha256: prefix to the denylist. The zero expiration time means
+// that the entries never expire. It returns the number of the entries that
+// were not in the denylist or had another expiration time.
+func (d *DeniedTokens) Add(entries []string, expiresAt time.Time) (int, error) {
+	var expiration int64
+	if !expiresAt.IsZero() {
+		expiration = expiresAt.Unix()
+	}
+
+	now := time.Now().Unix()
+
+	return d.update(entries, func(key digest) bool {
+		if current, found := d.lookup(&key, now); found && current == expiration {
+			return false
+		}
+		delete(d.removed, key)
+		d.added[key] = expiration
+		return true
+	})
+}
+
+// Remove removes the tokens, the claims in the claim:value format or the
+// digests with the sha256: prefix from the denylist. It returns the number of
+// the entries that were in the denylist.
+func (d *DeniedTokens) Remove(entries []string) (int, error) {
+	now := time.Now().Unix()
+
+	return d.update(entries, func(key digest) bool {
+		_, found := d.lookup(&key, now)
+
+		delete(d.added, key)
+		if d.fileSet.contains(&key) {
+			d.removed[key] = struct{}{}
+		}
+
+		return found
+	})
+}
+
+// update applies the change to the digest of each entry and writes the
+// denylist to the file if the persistence is enabled
+func (d *DeniedTokens) update(entries []string, apply func(key digest) bool) (int, error) {
+	keys := make([]digest, len(entries))
+	for i := range entries {
+		entry := strings.TrimSpace(entries[i])
+		if entry == "" {
+			return 0, fmt.Errorf("%w: empty token", ErrInvalidToken)
+		}
+
+		key, _, err := d.parseEntry(entry)
+		if err != nil {
+			return 0, err
+		}
+		keys[i] = key
+	}
+
+	d.updateMutex.Lock()
+	defer d.updateMutex.Unlock()
+
+	var changed int
+
+	d.mutex.Lock()
+	for _, key := range keys {
+		if apply(key) {
+			changed++
+		}
+	}
+	d.mutex.Unlock()
+
+	if changed == 0 || !d.persist {
+		return changed, nil
+	}
+
+	if err := d.save(); err != nil {
+		return changed, err
+	}
+
+	return changed, nil
+}
+
+// save writes the digests of the denylist to the file. The expired entries
+// are dropped. The file is replaced atomically, so the watcher never reads
+// the partially written file. The saved version of the file becomes the base
+// of the next diff.
+func (d *DeniedTokens) save() error {
+	records := d.records()
+
+	info, err := os.Stat(d.file)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(d.file), filepath.Base(d.file)+".*")
+	if err != nil {
+		return err
+	}
+
+	if err := writeRecords(f, records, info.Mode()); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+
 	if err := f.Close(); err != nil {
-		return nil, err
+		os.Remove(f.Name())
+		return err
 	}
 
-	return &DeniedTokens{Cache: cache, ElementsNum: totalEntries}, nil
+	if err := os.Rename(f.Name(), d.file); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	digests := make([]digest, len(records))
+	expires := make(map[digest]int64)
+	for i := range records {
+		digests[i] = records[i].key
+		if records[i].expiration != 0 {
+			expires[records[i].key] = records[i].expiration
+		}
+	}
+
+	fileSet := newDigestSet(digests, expires)
+
+	d.mutex.Lock()
+	d.fileSet = fileSet
+	d.added = make(map[digest]int64)
+	d.removed = make(map[digest]struct{})
+	d.mutex.Unlock()
+
+	return nil
+}
+
+func writeRecords(f *os.File, records []record, mode os.FileMode) error {
+	if err := f.Chmod(mode); err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	line := make([]byte, digestLineLen-1)
+	copy(line, DigestPrefix)
+
+	for i := range records {
+		hex.Encode(line[len(DigestPrefix):], records[i].key[:])
+		if _, err := w.Write(line); err != nil {
+			return err
+		}
+
+		if records[i].expiration != 0 {
+			if _, err := w.WriteString(" " + time.Unix(records[i].expiration, 0).UTC().Format(time.RFC3339)); err != nil {
+				return err
+			}
+		}
+
+		if err := w.WriteByte('\n'); err != nil {
+			return err
+		}
+	}
+
+	return w.Flush()
+}
+
+// Close stops watching the file
+func (d *DeniedTokens) Close() {
+	if d.fileWatcher != nil {
+		d.fileWatcher.Stop()
+	}
 }
@@ -0,0 +1,119 @@
+package denylist
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/wallarm/api-firewall/internal/config"
+)
+
+func newTestDeniedTokens(t *testing.T, tokens string) (*DeniedTokens, error) {
+	t.Helper()
+
+	tokensFile := t.TempDir() + "/tokens.db"
+	if err := os.WriteFile(tokensFile, []byte(tokens), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	deniedTokens, err := New(&config.APIFWConfiguration{
+		Denylist: config.Denylist{Tokens: config.Token{File: tokensFile, Claims: []string{"jti"}}},
+	}, logrus.New())
+	if err == nil {
+		t.Cleanup(deniedTokens.Close)
+	}
+
+	return deniedTokens, err
+}
+
+func TestDeniedTokensFile(t *testing.T) {
+
+	sum := sha256.Sum256([]byte("digest-token"))
+
+	deniedTokens, err := newTestDeniedTokens(t, fmt.Sprintf(`
+plaintext-token
+%s%s
+jti:revoked-jti
+expired-token %d
+expiring-token %s
+`, DigestPrefix, hex.EncodeToString(sum[:]), time.Now().Add(-time.Minute).Unix(), time.Now().Add(time.Hour).Format(time.RFC3339)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the expired entries are counted but not denied
+	if deniedTokens.Len() != 5 {
+		t.Errorf("Incorrect number of the denylist entries. Expected: 5 and got %d", deniedTokens.Len())
+	}
+
+	for token, denied := range map[string]bool{
+		"plaintext-token": true,
+		"digest-token":    true,
+		"jti:revoked-jti": true,
+		"expired-token":   false,
+		"expiring-token":  true,
+		"allowed-token":   false,
+		"":                false,
+	} {
+		if deniedTokens.Contains(token) != denied {
+			t.Errorf("%q: incorrect denylist result. Expected: %t", token, denied)
+		}
+	}
+
+	// only the entries that are not expired are listed
+	if entries := deniedTokens.List(); len(entries) != 4 {
+		t.Errorf("Incorrect number of the listed entries. Expected: 4 and got %d", len(entries))
+	}
+
+	invalid := map[string]string{
+		"invalid digest":     "sha256:xyz\n",
+		"short digest":       "sha256:0123abcd\n",
+		"invalid expiration": "token tomorrow\n",
+		"extra fields":       "token 1700000000 extra\n",
+	}
+
+	for name, data := range invalid {
+		if _, err := newTestDeniedTokens(t, data); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("%s: incorrect error. Expected: %v and got %v", name, ErrInvalidToken, err)
+		}
+	}
+}
+
+func TestDeniedTokensUpdate(t *testing.T) {
+
+	deniedTokens, err := newTestDeniedTokens(t, "file-token\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if added, err := deniedTokens.Add([]string{"added-token", "file-token"}, time.Time{}); err != nil || added != 1 {
+		t.Errorf("Incorrect result of the added tokens. Expected: 1 and got %d (%v)", added, err)
+	}
+
+	if removed, err := deniedTokens.Remove([]string{"file-token", "unknown-token"}); err != nil || removed != 1 {
+		t.Errorf("Incorrect result of the removed tokens. Expected: 1 and got %d (%v)", removed, err)
+	}
+
+	if !deniedTokens.Contains("added-token") || deniedTokens.Contains("file-token") {
+		t.Errorf("Incorrect denylist after the runtime changes: %v", deniedTokens.List())
+	}
+
+	// the token added with the past expiration time is not denied
+	if _, err := deniedTokens.Add([]string{"expired-token"}, time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	if deniedTokens.Contains("expired-token") {
+		t.Error("Expired token is denied")
+	}
+
+	if _, err := deniedTokens.Add([]string{""}, time.Time{}); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Incorrect error of the empty token. Expected: %v and got %v", ErrInvalidToken, err)
+	}
+}
@@ -0,0 +1,125 @@
+package denylist
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+)
+
+const (
+	// bloomBitsPerEntry and bloomHashes give about 1% of false positives
+	bloomBitsPerEntry = 10
+	bloomHashes       = 7
+)
+
+// digest is the SHA-256 of the token
+type digest [sha256.Size]byte
+
+func tokenDigest(token string) digest {
+	return sha256.Sum256([]byte(token))
+}
+
+// digestSet is the immutable sorted set of the digests fronted by the bloom
+// filter. The memory use is 32 bytes per entry plus 10 bits of the filter.
+// Most of the tokens of the requests are not denied, so the lookup usually
+// stops at the filter. The expiration times (unix seconds) are kept only for
+// the entries that expire.
+type digestSet struct {
+	digests []digest
+	expires map[digest]int64
+	bloom   []uint64
+	bits    uint64
+}
+
+// newDigestSet sorts the digests and removes the duplicates in place
+func newDigestSet(digests []digest, expires map[digest]int64) *digestSet {
+	sort.Slice(digests, func(i, j int) bool {
+		return bytes.Compare(digests[i][:], digests[j][:]) < 0
+	})
+
+	unique := digests[:0]
+	for i := range digests {
+		if i == 0 || digests[i] != digests[i-1] {
+			unique = append(unique, digests[i])
+		}
+	}
+
+	s := digestSet{digests: unique, expires: expires}
+
+	if len(unique) > 0 {
+		s.bits = uint64(len(unique)) * bloomBitsPerEntry
+		s.bloom = make([]uint64, (s.bits+63)/64)
+		for i := range unique {
+			h1, h2 := bloomHashPair(&unique[i])
+			for k := uint64(0); k < bloomHashes; k++ {
+				bit := (h1 + k*h2) % s.bits
+				s.bloom[bit/64] |= 1 << (bit % 64)
+			}
+		}
+	}
+
+	return &s
+}
+
+// bloomHashPair returns the hashes of the double hashing. The digest is
+// already uniformly distributed, so its parts are used as the hashes.
+func bloomHashPair(d *digest) (uint64, uint64) {
+	return binary.LittleEndian.Uint64(d[0:8]), binary.LittleEndian.Uint64(d[8:16]) | 1
+}
+
+func (s *digestSet) len() int {
+	return len(s.digests)
+}
+
+func (s *digestSet) contains(d *digest) bool {
+	if len(s.digests) == 0 {
+		return false
+	}
+
+	h1, h2 := bloomHashPair(d)
+	for k := uint64(0); k < bloomHashes; k++ {
+		bit := (h1 + k*h2) % s.bits
+		if s.bloom[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+
+	i := sort.Search(len(s.digests), func(i int) bool {
+		return bytes.Compare(s.digests[i][:], d[:]) >= 0
+	})
+
+	return i < len(s.digests) && s.digests[i] == *d
+}
+
+// expiration returns the expiration time of the digest, 0 if the digest
+// never expires
+func (s *digestSet) expiration(d *digest) int64 {
+	return s.expires[*d]
+}
+
+// expired checks the expiration time at the unix time now
+func expired(expiration, now int64) bool {
+	return expiration != 0 && now >= expiration
+}
+
+// diff returns the number of the digests added to and removed from the set
+// by the new version of the set
+func (s *digestSet) diff(next *digestSet) (added, removed int) {
+	i, j := 0, 0
+	for i < len(s.digests) && j < len(next.digests) {
+		switch c := bytes.Compare(s.digests[i][:], next.digests[j][:]); {
+		case c < 0:
+			removed++
+			i++
+		case c > 0:
+			added++
+			j++
+		default:
+			i++
+			j++
+		}
+	}
+
+	return added + len(next.digests) - j, removed + len(s.digests) - i
+}
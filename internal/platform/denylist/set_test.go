@@ -0,0 +1,71 @@
+package denylist
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestDigestSet(t *testing.T) {
+
+	const total = 100000
+
+	digests := make([]digest, 0, total+1)
+	for i := 0; i < total; i++ {
+		digests = append(digests, tokenDigest(fmt.Sprintf("denied-%d", i)))
+	}
+
+	// the duplicates are removed
+	digests = append(digests, tokenDigest("denied-0"))
+
+	expiring := tokenDigest("denied-1")
+	set := newDigestSet(digests, map[digest]int64{expiring: 1000})
+
+	if set.len() != total {
+		t.Errorf("Incorrect number of the digests. Expected: %d and got %d", total, set.len())
+	}
+
+	// no entry is dropped and the false positives of the filter are not found
+	for i := 0; i < total; i++ {
+		if d := tokenDigest(fmt.Sprintf("denied-%d", i)); !set.contains(&d) {
+			t.Fatalf("Digest of denied-%d is not found", i)
+		}
+		if d := tokenDigest(fmt.Sprintf("allowed-%d", i)); set.contains(&d) {
+			t.Fatalf("Digest of allowed-%d is found", i)
+		}
+	}
+
+	if expiration := set.expiration(&expiring); expiration != 1000 || !expired(expiration, 1000) || expired(expiration, 999) {
+		t.Errorf("Incorrect expiration of the digest: %d", expiration)
+	}
+
+	if d := tokenDigest("denied-2"); set.expiration(&d) != 0 || expired(set.expiration(&d), 1<<40) {
+		t.Error("Digest without the expiration time expires")
+	}
+
+	empty := newDigestSet(nil, nil)
+	if d := tokenDigest("denied-0"); empty.len() != 0 || empty.contains(&d) {
+		t.Error("Digest is found in the empty set")
+	}
+}
+
+func TestDigestSetDiff(t *testing.T) {
+
+	digests := func(tokens ...string) []digest {
+		var digests []digest
+		for _, token := range tokens {
+			digests = append(digests, tokenDigest(token))
+		}
+		return digests
+	}
+
+	prev := newDigestSet(digests("a", "b", "c"), nil)
+	next := newDigestSet(digests("b", "c", "d", "e"), nil)
+
+	if added, removed := prev.diff(next); added != 2 || removed != 1 {
+		t.Errorf("Incorrect difference of the sets. Expected: 2 added and 1 removed and got %d added and %d removed", added, removed)
+	}
+
+	if added, removed := next.diff(newDigestSet(nil, nil)); added != 0 || removed != 4 {
+		t.Errorf("Incorrect difference with the empty set. Expected: 0 added and 4 removed and got %d added and %d removed", added, removed)
+	}
+}
@@ -0,0 +1,267 @@
+package geoip
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/sirupsen/logrus"
+
+	"github.com/wallarm/api-firewall/internal/config"
+	"github.com/wallarm/api-firewall/internal/platform/watcher"
+)
+
+// Location is the country and the autonomous system of the IP address
+type Location struct {
+	Country string
+	ASN     uint
+	ASOrg   string
+}
+
+type countryRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+}
+
+type asnRecord struct {
+	ASN   uint   `maxminddb:"autonomous_system_number"`
+	ASOrg string `maxminddb:"autonomous_system_organization"`
+}
+
+// Database is the pair of the local MaxMind databases of the countries
+// (GeoIP2/GeoLite2 Country or City) and the autonomous systems (GeoLite2 ASN)
+type Database struct {
+	country *reader
+	asn     *reader
+}
+
+// New loads the configured databases and starts watching the files for
+// changes. It returns nil if no database is configured.
+func New(cfg *config.GeoIP, logger *logrus.Logger) (*Database, error) {
+	if cfg.CountryDatabase == "" && cfg.ASNDatabase == "" {
+		return nil, nil
+	}
+
+	var db Database
+	var err error
+
+	if cfg.CountryDatabase != "" {
+		if db.country, err = newReader(cfg.CountryDatabase, cfg.UpdateInterval, logger); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.ASNDatabase != "" {
+		if db.asn, err = newReader(cfg.ASNDatabase, cfg.UpdateInterval, logger); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	return &db, nil
+}
+
+// Lookup returns the location of the IP address. The fields which are not
+// found in the databases are empty.
+func (d *Database) Lookup(ip net.IP) Location {
+	var location Location
+
+	if d.country != nil {
+		var record countryRecord
+		if err := d.country.lookup(ip, &record); err == nil {
+			location.Country = record.Country.ISOCode
+			if location.Country == "" {
+				location.Country = record.RegisteredCountry.ISOCode
+			}
+		}
+	}
+
+	if d.asn != nil {
+		var record asnRecord
+		if err := d.asn.lookup(ip, &record); err == nil {
+			location.ASN, location.ASOrg = record.ASN, record.ASOrg
+		}
+	}
+
+	return location
+}
+
+// Close stops watching the database files
+func (d *Database) Close() {
+	for _, r := range []*reader{d.country, d.asn} {
+		if r != nil && r.fileWatcher != nil {
+			r.fileWatcher.Stop()
+		}
+	}
+}
+
+// reader is the MaxMind database reloaded on change of the file
+type reader struct {
+	file   string
+	logger *logrus.Logger
+
+	mutex sync.RWMutex
+	db    *maxminddb.Reader
+
+	fileWatcher *watcher.Watcher
+}
+
+func newReader(file string, updateInterval time.Duration, logger *logrus.Logger) (*reader, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("GeoIP: %w", err)
+	}
+
+	r := reader{file: file, logger: logger}
+	if err := r.load(data); err != nil {
+		return nil, err
+	}
+
+	if updateInterval > 0 {
+		r.fileWatcher = watcher.New(file, updateInterval, func() ([]byte, error) {
+			return ioutil.ReadFile(file)
+		}, r.load, logger)
+		r.fileWatcher.Start(data)
+	}
+
+	return &r, nil
+}
+
+// load replaces the database. The previous database is not closed, it is
+// still used by the concurrent lookups.
+func (r *reader) load(data []byte) error {
+	db, err := maxminddb.FromBytes(data)
+	if err != nil {
+		return fmt.Errorf("GeoIP: %s: %w", r.file, err)
+	}
+
+	r.mutex.Lock()
+	r.db = db
+	r.mutex.Unlock()
+
+	r.logger.Infof("GeoIP: %s: %s database loaded (build epoch %d)", r.file, db.Metadata.DatabaseType, db.Metadata.BuildEpoch)
+
+	return nil
+}
+
+func (r *reader) lookup(ip net.IP, record interface{}) error {
+	r.mutex.RLock()
+	db := r.db
+	r.mutex.RUnlock()
+
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	return db.Lookup(ip, record)
+}
+
+// Rules are the allow and deny lists of the countries (ISO 3166-1 alpha-2
+// codes) and the autonomous system numbers. The deny lists take precedence
+// over the allow lists. The client of the unknown location is not allowed by
+// the allow list.
+type Rules struct {
+	AllowCountries []string `json:"allowCountries"`
+	DenyCountries  []string `json:"denyCountries"`
+	AllowASNs      []uint   `json:"allowASNs"`
+	DenyASNs       []uint   `json:"denyASNs"`
+}
+
+// NewRules returns the global rules. It returns nil if no rule is configured.
+func NewRules(cfg *config.GeoIP) *Rules {
+	rules := Rules{
+		AllowCountries: cfg.AllowCountries,
+		DenyCountries:  cfg.DenyCountries,
+		AllowASNs:      cfg.AllowASNs,
+		DenyASNs:       cfg.DenyASNs,
+	}
+
+	if rules.Empty() {
+		return nil
+	}
+
+	return &rules
+}
+
+// Empty checks that no rule is set
+func (r *Rules) Empty() bool {
+	return len(r.AllowCountries) == 0 && len(r.DenyCountries) == 0 && len(r.AllowASNs) == 0 && len(r.DenyASNs) == 0
+}
+
+// Validate checks the country codes and that the databases used by the rules
+// are loaded
+func (r *Rules) Validate(db *Database) error {
+	for _, countries := range [][]string{r.AllowCountries, r.DenyCountries} {
+		for _, country := range countries {
+			if len(country) != 2 || !isLetter(country[0]) || !isLetter(country[1]) {
+				return fmt.Errorf("invalid country code %q", country)
+			}
+		}
+	}
+
+	if (len(r.AllowCountries) > 0 || len(r.DenyCountries) > 0) && (db == nil || db.country == nil) {
+		return fmt.Errorf("country rules are set but the country database is not configured")
+	}
+
+	if (len(r.AllowASNs) > 0 || len(r.DenyASNs) > 0) && (db == nil || db.asn == nil) {
+		return fmt.Errorf("ASN rules are set but the ASN database is not configured")
+	}
+
+	return nil
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// Check returns the rule (country or asn) which rejects the location or the
+// empty string if the location is allowed
+func (r *Rules) Check(location Location) string {
+	if containsCountry(r.DenyCountries, location.Country) ||
+		(len(r.AllowCountries) > 0 && !containsCountry(r.AllowCountries, location.Country)) {
+		return "country"
+	}
+
+	if containsASN(r.DenyASNs, location.ASN) ||
+		(len(r.AllowASNs) > 0 && !containsASN(r.AllowASNs, location.ASN)) {
+		return "asn"
+	}
+
+	return ""
+}
+
+func containsCountry(countries []string, country string) bool {
+	if country == "" {
+		return false
+	}
+
+	for _, c := range countries {
+		if strings.EqualFold(c, country) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsASN(asns []uint, asn uint) bool {
+	if asn == 0 {
+		return false
+	}
+
+	for _, a := range asns {
+		if a == asn {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,122 @@
+package geoip
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/wallarm/api-firewall/internal/config"
+	"github.com/wallarm/api-firewall/internal/platform/tests"
+)
+
+func writeTestDatabases(t *testing.T, dir, country string) {
+	t.Helper()
+
+	tests.WriteMMDB(t, dir+"/country.mmdb", "GeoLite2-Country", []tests.MMDBNetwork{
+		{CIDR: "198.51.100.0/24", Record: map[string]interface{}{"country": map[string]interface{}{"iso_code": country}}},
+		{CIDR: "198.18.0.0/15", Record: map[string]interface{}{"registered_country": map[string]interface{}{"iso_code": "US"}}},
+	})
+
+	tests.WriteMMDB(t, dir+"/asn.mmdb", "GeoLite2-ASN", []tests.MMDBNetwork{
+		{CIDR: "198.51.100.0/24", Record: map[string]interface{}{"autonomous_system_number": uint(64500), "autonomous_system_organization": "Example DE"}},
+	})
+}
+
+func TestLookup(t *testing.T) {
+
+	dir := t.TempDir()
+	writeTestDatabases(t, dir, "DE")
+
+	db, err := New(&config.GeoIP{
+		CountryDatabase: dir + "/country.mmdb",
+		ASNDatabase:     dir + "/asn.mmdb",
+		UpdateInterval:  20 * time.Millisecond,
+	}, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for ip, expected := range map[string]Location{
+		"198.51.100.10":        {Country: "DE", ASN: 64500, ASOrg: "Example DE"},
+		"::ffff:198.51.100.10": {Country: "DE", ASN: 64500, ASOrg: "Example DE"},
+		"198.18.1.1":           {Country: "US"},
+		"10.0.0.1":             {},
+	} {
+		if location := db.Lookup(net.ParseIP(ip)); location != expected {
+			t.Errorf("%s: incorrect location. Expected: %+v and got %+v", ip, expected, location)
+		}
+	}
+
+	// the database is reloaded on change of the file
+	writeTestDatabases(t, dir, "FR")
+
+	for i := 0; i < 100 && db.Lookup(net.ParseIP("198.51.100.10")).Country != "FR"; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if location := db.Lookup(net.ParseIP("198.51.100.10")); location.Country != "FR" {
+		t.Errorf("Incorrect location after the database update: %+v", location)
+	}
+
+	if _, err := New(&config.GeoIP{CountryDatabase: dir + "/missing.mmdb"}, logrus.New()); err == nil {
+		t.Error("Missing database has been loaded")
+	}
+}
+
+func TestRules(t *testing.T) {
+
+	rules := NewRules(&config.GeoIP{
+		AllowCountries: []string{"de", "FR"},
+		DenyCountries:  []string{"FR"},
+		DenyASNs:       []uint{64502},
+	})
+
+	for _, tc := range []struct {
+		location Location
+		rule     string
+	}{
+		{Location{Country: "DE", ASN: 64500}, ""},
+		{Location{Country: "FR", ASN: 64500}, "country"},
+		{Location{Country: "US"}, "country"},
+		{Location{}, "country"},
+		{Location{Country: "DE", ASN: 64502}, "asn"},
+	} {
+		if rule := rules.Check(tc.location); rule != tc.rule {
+			t.Errorf("%+v: incorrect rule. Expected: %q and got %q", tc.location, tc.rule, rule)
+		}
+	}
+
+	// the client of the unknown location is not rejected by the deny lists only
+	denyRules := Rules{DenyCountries: []string{"FR"}, DenyASNs: []uint{64502}}
+	if rule := denyRules.Check(Location{}); rule != "" {
+		t.Errorf("Unknown location is rejected by the deny rules: %q", rule)
+	}
+
+	if NewRules(&config.GeoIP{}) != nil {
+		t.Error("Empty rules have been created")
+	}
+
+	dir := t.TempDir()
+	writeTestDatabases(t, dir, "DE")
+
+	countryDB, err := New(&config.GeoIP{CountryDatabase: dir + "/country.mmdb"}, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer countryDB.Close()
+
+	if err := rules.Validate(countryDB); err == nil {
+		t.Error("ASN rules are validated without the ASN database")
+	}
+
+	if err := (&Rules{AllowCountries: []string{"DE"}}).Validate(countryDB); err != nil {
+		t.Errorf("Country rules are not validated: %s", err)
+	}
+
+	if err := (&Rules{AllowCountries: []string{"DEU"}}).Validate(countryDB); err == nil {
+		t.Error("Invalid country code is validated")
+	}
+}
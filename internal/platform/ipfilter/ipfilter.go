@@ -0,0 +1,203 @@
+package ipfilter
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/wallarm/api-firewall/internal/config"
+	"github.com/wallarm/api-firewall/internal/platform/watcher"
+)
+
+// List is the list of the IPv4 and IPv6 networks. The networks of the file
+// are reloaded on change of the file, the configured entries are kept.
+type List struct {
+	name   string
+	static []*net.IPNet
+	logger *logrus.Logger
+
+	mutex    sync.RWMutex
+	networks []*net.IPNet
+
+	fileWatcher *watcher.Watcher
+}
+
+// NewList returns the list of the configured entries and the entries of the
+// file. The file lines are the IP addresses or the CIDRs, empty lines and
+// lines starting with # are skipped. It returns nil if neither the entries
+// nor the file are configured.
+func NewList(name string, cfg *config.IPList, updateInterval time.Duration, logger *logrus.Logger) (*List, error) {
+	if len(cfg.Entries) == 0 && cfg.File == "" {
+		return nil, nil
+	}
+
+	static, err := ParseNetworks(cfg.Entries)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	list := List{name: name, static: static, networks: static, logger: logger}
+
+	if cfg.File == "" {
+		return &list, nil
+	}
+
+	data, err := ioutil.ReadFile(cfg.File)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	if err := list.load(data); err != nil {
+		return nil, err
+	}
+
+	if updateInterval > 0 {
+		list.fileWatcher = watcher.New(cfg.File, updateInterval, func() ([]byte, error) {
+			return ioutil.ReadFile(cfg.File)
+		}, list.load, logger)
+		list.fileWatcher.Start(data)
+	}
+
+	return &list, nil
+}
+
+// ParseNetworks converts the IP addresses and the CIDRs of the IP lists and
+// the trusted proxies to networks. It returns the error on the invalid entry.
+func ParseNetworks(entries []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(entries))
+
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			networks = append(networks, network)
+			continue
+		}
+
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address or CIDR %q", entry)
+		}
+
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+
+	return networks, nil
+}
+
+// load replaces the networks of the file
+func (l *List) load(data []byte) error {
+	var entries []string
+
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		if entry := strings.TrimSpace(s.Text()); entry != "" && !strings.HasPrefix(entry, "#") {
+			entries = append(entries, entry)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return fmt.Errorf("%s: %w", l.name, err)
+	}
+
+	fileNetworks, err := ParseNetworks(entries)
+	if err != nil {
+		return fmt.Errorf("%s: %w", l.name, err)
+	}
+
+	networks := make([]*net.IPNet, 0, len(l.static)+len(fileNetworks))
+	networks = append(networks, l.static...)
+	networks = append(networks, fileNetworks...)
+
+	l.mutex.Lock()
+	l.networks = networks
+	l.mutex.Unlock()
+
+	l.logger.Infof("IP filter: %s: %d networks loaded", l.name, len(networks))
+
+	return nil
+}
+
+// Contains checks that the IP address belongs to one of the networks
+func (l *List) Contains(ip net.IP) bool {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	for _, network := range l.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Close stops watching the file
+func (l *List) Close() {
+	if l.fileWatcher != nil {
+		l.fileWatcher.Stop()
+	}
+}
+
+// Filter is the pair of the allow and the deny lists. A nil list is not
+// checked. The deny list takes precedence over the allow list.
+type Filter struct {
+	Allow *List
+	Deny  *List
+}
+
+// New returns the filter of the configured lists. It returns nil if no list
+// is configured.
+func New(cfg *config.IPFilter, logger *logrus.Logger) (*Filter, error) {
+	allow, err := NewList("allow", &cfg.Allow, cfg.UpdateInterval, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	deny, err := NewList("deny", &cfg.Deny, cfg.UpdateInterval, logger)
+	if err != nil {
+		if allow != nil {
+			allow.Close()
+		}
+		return nil, err
+	}
+
+	if allow == nil && deny == nil {
+		return nil, nil
+	}
+
+	return &Filter{Allow: allow, Deny: deny}, nil
+}
+
+// Check returns the name of the list which rejects the IP address or the
+// empty string if the address is allowed
+func (f *Filter) Check(ip net.IP) string {
+	if f.Deny != nil && f.Deny.Contains(ip) {
+		return "deny"
+	}
+
+	if f.Allow != nil && !f.Allow.Contains(ip) {
+		return "allow"
+	}
+
+	return ""
+}
+
+// Close stops watching the files of the lists
+func (f *Filter) Close() {
+	for _, list := range []*List{f.Allow, f.Deny} {
+		if list != nil {
+			list.Close()
+		}
+	}
+}
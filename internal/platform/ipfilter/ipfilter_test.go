@@ -0,0 +1,111 @@
+package ipfilter
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/wallarm/api-firewall/internal/config"
+)
+
+func TestParseNetworks(t *testing.T) {
+
+	networks, err := ParseNetworks([]string{"10.0.0.0/8", " 192.0.2.1 ", "2001:db8::/32", "2001:db8:bad::1", "::ffff:198.51.100.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"10.0.0.0/8", "192.0.2.1/32", "2001:db8::/32", "2001:db8:bad::1/128", "198.51.100.1/32"}
+	if len(networks) != len(expected) {
+		t.Fatalf("Incorrect number of the networks. Expected: %d and got %d", len(expected), len(networks))
+	}
+
+	for i, network := range networks {
+		if network.String() != expected[i] {
+			t.Errorf("Incorrect network. Expected: %s and got %s", expected[i], network)
+		}
+	}
+
+	for _, entry := range []string{"10.0.0.0/33", "192.0.2.300", "example.com", ""} {
+		if _, err := ParseNetworks([]string{entry}); err == nil {
+			t.Errorf("Invalid entry %q has been parsed", entry)
+		}
+	}
+}
+
+func TestFilter(t *testing.T) {
+
+	filter, err := New(&config.IPFilter{
+		Allow: config.IPList{Entries: []string{"10.0.0.0/8", "2001:db8::/32"}},
+		Deny:  config.IPList{Entries: []string{"10.0.0.7", "2001:db8:bad::/48"}},
+	}, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer filter.Close()
+
+	for ip, list := range map[string]string{
+		"10.1.1.1":        "",
+		"2001:db8::1":     "",
+		"10.0.0.7":        "deny",
+		"2001:db8:bad::1": "deny",
+		"192.0.2.1":       "allow",
+		"::ffff:10.1.1.1": "",
+	} {
+		if result := filter.Check(net.ParseIP(ip)); result != list {
+			t.Errorf("%s: incorrect IP filter result. Expected: %q and got %q", ip, list, result)
+		}
+	}
+
+	if filter, err := New(&config.IPFilter{}, logrus.New()); filter != nil || err != nil {
+		t.Errorf("Filter without the lists has been created: %v", err)
+	}
+
+	if _, err := New(&config.IPFilter{Deny: config.IPList{Entries: []string{"10.0.0.300"}}}, logrus.New()); err == nil {
+		t.Error("Filter with the invalid entry has been created")
+	}
+}
+
+func TestListReload(t *testing.T) {
+
+	denyFile := t.TempDir() + "/deny.txt"
+	if err := os.WriteFile(denyFile, []byte("# blocked clients\n203.0.113.7\n\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := NewList("deny", &config.IPList{Entries: []string{"2001:db8:bad::/48"}, File: denyFile}, 20*time.Millisecond, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer list.Close()
+
+	if !list.Contains(net.ParseIP("203.0.113.7")) || !list.Contains(net.ParseIP("2001:db8:bad::1")) {
+		t.Error("Networks of the file and the entries are not loaded")
+	}
+
+	// the networks of the file are reloaded without restart, the entries are kept
+	if err := os.WriteFile(denyFile, []byte("198.51.100.0/24\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	blocked := net.ParseIP("198.51.100.10")
+	for i := 0; i < 100 && !list.Contains(blocked); i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if !list.Contains(blocked) || list.Contains(net.ParseIP("203.0.113.7")) || !list.Contains(net.ParseIP("2001:db8:bad::1")) {
+		t.Error("Incorrect networks after the file update")
+	}
+
+	// the networks of the invalid file are not applied
+	if err := list.load([]byte("198.51.100.300\n")); err == nil {
+		t.Error("Invalid file has been loaded")
+	}
+
+	if !list.Contains(blocked) {
+		t.Error("Networks are replaced by the invalid file")
+	}
+}
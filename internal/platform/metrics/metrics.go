@@ -0,0 +1,173 @@
+package metrics
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/fasthttp/router"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttpadaptor"
+)
+
+const (
+	namespace = "apifw"
+
+	unknownRoute  = "unknown"
+	unknownMethod = "other"
+
+	UpstreamDialTimeout = "dial_timeout"
+	UpstreamNoFreeConns = "no_free_conns"
+	UpstreamBadGateway  = "bad_gateway"
+)
+
+var (
+	Requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "Total number of processed requests by route, method and status code.",
+	}, []string{"route", "method", "status"})
+
+	RequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time spent processing requests including the upstream round trip.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	RequestValidationErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "request_validation_errors_total",
+		Help:      "Total number of requests that failed the validation by reason.",
+	}, []string{"reason"})
+
+	ResponseValidationErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "response_validation_errors_total",
+		Help:      "Total number of responses that failed the validation by reason.",
+	}, []string{"reason"})
+
+	ShadowAPIRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "shadow_api_requests_total",
+		Help:      "Total number of requests to the endpoints which are not described in the API spec.",
+	}, []string{"method", "status"})
+
+	DenylistBlocks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "denylist_blocked_requests_total",
+		Help:      "Total number of requests blocked because of the denied token by token source.",
+	}, []string{"source"})
+
+	IPFilterBlocks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ip_filter_blocked_requests_total",
+		Help:      "Total number of requests blocked because of the client IP address by list (allow, deny).",
+	}, []string{"list"})
+
+	GeoIPBlocks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "geoip_blocked_requests_total",
+		Help:      "Total number of requests blocked because of the client location by rule (country, asn).",
+	}, []string{"rule"})
+
+	RateLimitRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limit_rejected_requests_total",
+		Help:      "Total number of requests rejected because of the rate limit by limit key.",
+	}, []string{"key"})
+
+	OAuthFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "oauth_failures_total",
+		Help:      "Total number of failed OAuth2 token validations by validation type.",
+	}, []string{"type"})
+
+	UpstreamDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "upstream_request_duration_seconds",
+		Help:      "Time spent waiting for the upstream response.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	UpstreamErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_errors_total",
+		Help:      "Total number of failed upstream requests by reason.",
+	}, []string{"reason"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		Requests,
+		RequestDuration,
+		RequestValidationErrors,
+		ResponseValidationErrors,
+		ShadowAPIRequests,
+		DenylistBlocks,
+		IPFilterBlocks,
+		GeoIPBlocks,
+		RateLimitRejections,
+		OAuthFailures,
+		UpstreamDuration,
+		UpstreamErrors,
+	)
+}
+
+// Method returns the method label of the request. Methods which are not
+// defined by the HTTP specs are reported as "other", so the clients can't
+// create the unbounded number of the label values.
+func Method(method []byte) string {
+	switch string(method) {
+	case fasthttp.MethodGet, fasthttp.MethodHead, fasthttp.MethodPost, fasthttp.MethodPut,
+		fasthttp.MethodPatch, fasthttp.MethodDelete, fasthttp.MethodConnect,
+		fasthttp.MethodOptions, fasthttp.MethodTrace:
+		return string(method)
+	}
+	return unknownMethod
+}
+
+// PoolLen is implemented by the pools of the upstream clients.
+type PoolLen interface {
+	Len() int
+}
+
+// RegisterPool exposes the number of upstream clients available in the pool of the API.
+func RegisterPool(api, upstream string, pool PoolLen) error {
+	gauge := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Name:        "proxy_pool_available_clients",
+		Help:        "Number of upstream clients available in the pool.",
+		ConstLabels: prometheus.Labels{"api": api, "upstream": upstream},
+	}, func() float64 {
+		return float64(pool.Len())
+	})
+
+	return prometheus.Register(gauge)
+}
+
+// Handler returns the handler which exposes the registered metrics in the Prometheus format.
+func Handler() fasthttp.RequestHandler {
+	return fasthttpadaptor.NewFastHTTPHandler(promhttp.Handler())
+}
+
+// RequestHandler collects the number of processed requests and the
+// processing time of the requests served by the handler. The route label is
+// the path of the matched route or "unknown" if no route has been found.
+func RequestHandler(handler fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		start := time.Now()
+
+		handler(ctx)
+
+		route, ok := ctx.UserValue(router.MatchedRoutePathParam).(string)
+		if !ok || route == "" {
+			route = unknownRoute
+		}
+		method := Method(ctx.Method())
+
+		Requests.WithLabelValues(route, method, strconv.Itoa(ctx.Response.StatusCode())).Inc()
+		RequestDuration.WithLabelValues(route, method).Observe(time.Since(start).Seconds())
+	}
+}
@@ -0,0 +1,70 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/fasthttp/router"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/valyala/fasthttp"
+)
+
+func TestMethod(t *testing.T) {
+
+	for method, expected := range map[string]string{
+		"GET":     "GET",
+		"OPTIONS": "OPTIONS",
+		"get":     unknownMethod,
+		"RANDOM":  unknownMethod,
+		"":        unknownMethod,
+	} {
+		if label := Method([]byte(method)); label != expected {
+			t.Errorf("Incorrect label of the method %q. Expected: %s and got %s", method, expected, label)
+		}
+	}
+}
+
+func TestRequestHandler(t *testing.T) {
+
+	handler := RequestHandler(func(ctx *fasthttp.RequestCtx) {
+		if string(ctx.Path()) != "/unknown" {
+			ctx.SetUserValue(router.MatchedRoutePathParam, "/metrics/{id}")
+		}
+		ctx.SetStatusCode(fasthttp.StatusOK)
+	})
+
+	counters := map[string]float64{
+		"GET":   testutil.ToFloat64(Requests.WithLabelValues("/metrics/{id}", "GET", "200")),
+		"other": testutil.ToFloat64(Requests.WithLabelValues("/metrics/{id}", unknownMethod, "200")),
+		"route": testutil.ToFloat64(Requests.WithLabelValues(unknownRoute, "GET", "200")),
+	}
+
+	for _, request := range []struct{ method, uri string }{
+		{"GET", "/metrics/1"},
+		{"RANDOM-1", "/metrics/1"},
+		{"RANDOM-2", "/metrics/2"},
+		{"GET", "/unknown"},
+	} {
+		var reqCtx fasthttp.RequestCtx
+		reqCtx.Request.SetRequestURI(request.uri)
+		reqCtx.Request.Header.SetMethod(request.method)
+
+		handler(&reqCtx)
+	}
+
+	// the unknown methods share the single label value
+	if value := testutil.ToFloat64(Requests.WithLabelValues("/metrics/{id}", "GET", "200")); value != counters["GET"]+1 {
+		t.Errorf("Incorrect number of the GET requests. Expected: %v and got %v", counters["GET"]+1, value)
+	}
+
+	if value := testutil.ToFloat64(Requests.WithLabelValues("/metrics/{id}", unknownMethod, "200")); value != counters["other"]+2 {
+		t.Errorf("Incorrect number of the requests with unknown methods. Expected: %v and got %v", counters["other"]+2, value)
+	}
+
+	if value := testutil.ToFloat64(Requests.WithLabelValues(unknownRoute, "GET", "200")); value != counters["route"]+1 {
+		t.Errorf("Incorrect number of the requests without route. Expected: %v and got %v", counters["route"]+1, value)
+	}
+
+	if n := testutil.CollectAndCount(Requests); n > 3 {
+		t.Errorf("Unknown methods are used as the label values: %d series", n)
+	}
+}
@@ -0,0 +1,351 @@
+package oauth2
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// maxNumericDate is the max value of the numeric date claims
+// (9999-12-31T23:59:59Z). The larger values don't fit the time.Time
+// comparisons and are rejected.
+const maxNumericDate = 253402300799
+
+// Reasons of the token validation errors
+const (
+	ReasonInvalidToken    = "invalid token"
+	ReasonTokenExpired    = "token expired"
+	ReasonTokenNotValid   = "token not valid yet"
+	ReasonInvalidIssuer   = "invalid issuer"
+	ReasonInvalidAudience = "invalid audience"
+	ReasonMissingClaim    = "missing required claim"
+	ReasonInvalidClaim    = "invalid claim value"
+	ReasonMissingScope    = "missing scope"
+	ReasonTokenInactive   = "inactive token"
+	ReasonInvalidClient   = "invalid client"
+	ReasonOwnerMismatch   = "object owner mismatch"
+	ReasonAccessDenied    = "access denied"
+
+	// the discovery document of the OpenID provider is not loaded
+	ReasonProviderUnavailable = "identity provider unavailable"
+)
+
+// ValidationError is returned if the token is rejected. The reason is
+// reported as the reason of the security requirements error.
+type ValidationError struct {
+	Reason string
+	Err    error
+}
+
+func (e *ValidationError) Error() string {
+	if e.Err == nil {
+		return e.Reason
+	}
+	return fmt.Sprintf("%s: %s", e.Reason, e.Err)
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// Claims of the validated token
+type Claims map[string]interface{}
+
+// ClaimRequirements is the list of the allowed values of the required claims.
+// The claim with the empty list of values should be present in the token.
+type ClaimRequirements map[string][]string
+
+// UnmarshalJSON decodes the required claims. The allowed value of the claim
+// could be a single value, the list of values or null.
+func (r *ClaimRequirements) UnmarshalJSON(data []byte) error {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	requirements := make(ClaimRequirements, len(raw))
+	for name, value := range raw {
+		requirements[name] = claimValues(value)
+	}
+
+	*r = requirements
+	return nil
+}
+
+// ParseClaimRequirements parses the required claims in the "claim" or
+// "claim=value" format. Values of the same claim are merged.
+func ParseClaimRequirements(requirements []string) ClaimRequirements {
+	if len(requirements) == 0 {
+		return nil
+	}
+
+	parsed := make(ClaimRequirements, len(requirements))
+
+	for _, requirement := range requirements {
+		name, value, hasValue := cut(strings.TrimSpace(requirement), "=")
+		if name == "" {
+			continue
+		}
+
+		if hasValue {
+			parsed[name] = append(parsed[name], value)
+			continue
+		}
+
+		if _, ok := parsed[name]; !ok {
+			parsed[name] = nil
+		}
+	}
+
+	return parsed
+}
+
+// ClaimHeader is the request header with the value of the validated claim
+type ClaimHeader struct {
+	Claim  string
+	Header string
+}
+
+// ParseClaimHeaders parses the claim to header mapping in the "claim=Header"
+// format. Entries without the header name are skipped.
+func ParseClaimHeaders(mapping []string) []ClaimHeader {
+	var headers []ClaimHeader
+
+	for _, entry := range mapping {
+		claim, header, ok := cut(strings.TrimSpace(entry), "=")
+		claim, header = strings.TrimSpace(claim), strings.TrimSpace(header)
+		if !ok || claim == "" || header == "" {
+			continue
+		}
+
+		headers = append(headers, ClaimHeader{Claim: claim, Header: header})
+	}
+
+	return headers
+}
+
+// Values returns the string representations of the claim values. Claims of
+// the nested objects are referenced by the dot separated path, e.g.
+// realm_access.roles, if the claim with the exact name is not found.
+func (c Claims) Values(name string) []string {
+	if value, ok := c[name]; ok {
+		return claimValues(value)
+	}
+
+	var value interface{} = map[string]interface{}(c)
+	for _, key := range strings.Split(name, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		if value, ok = object[key]; !ok {
+			return nil
+		}
+	}
+
+	return claimValues(value)
+}
+
+// HeaderValue returns the value of the claim for the request header. Values
+// of the array claim are joined with commas.
+func (c Claims) HeaderValue(name string) (string, bool) {
+	value, ok := c[name]
+	if !ok || value == nil {
+		return "", false
+	}
+
+	return strings.Join(claimValues(value), ","), true
+}
+
+func cut(s, sep string) (string, string, bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
+
+// claimValues returns the string representations of the claim value. Each
+// element of the array claim is the separate value.
+func claimValues(value interface{}) []string {
+	switch value := value.(type) {
+	case nil:
+		return nil
+	case string:
+		return []string{value}
+	case []interface{}:
+		var values []string
+		for _, v := range value {
+			values = append(values, claimValues(v)...)
+		}
+		return values
+	case []string:
+		return value
+	case json.Number:
+		return []string{value.String()}
+	}
+
+	return []string{fmt.Sprint(value)}
+}
+
+// CheckClaims checks that the claims contain the required claims with one of
+// the allowed values
+func CheckClaims(claims Claims, required ClaimRequirements) error {
+	for name, allowed := range required {
+		values := claims.Values(name)
+		if values == nil {
+			return &ValidationError{Reason: ReasonMissingClaim, Err: fmt.Errorf("claim %s not found", name)}
+		}
+
+		if len(allowed) == 0 {
+			continue
+		}
+
+		if !containsAny(values, allowed) {
+			return &ValidationError{Reason: ReasonInvalidClaim, Err: fmt.Errorf("claim %s has invalid value", name)}
+		}
+	}
+
+	return nil
+}
+
+func containsAny(values []string, allowed []string) bool {
+	for _, value := range values {
+		for _, a := range allowed {
+			if value == a {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// numericDate returns the time of the numeric date claim
+func numericDate(claims Claims, name string) (time.Time, bool, error) {
+	value, ok := claims[name]
+	if !ok || value == nil {
+		return time.Time{}, false, nil
+	}
+
+	var seconds float64
+
+	switch value := value.(type) {
+	case float64:
+		seconds = value
+	case json.Number:
+		v, err := value.Float64()
+		if err != nil {
+			return time.Time{}, false, fmt.Errorf("claim %s is not a numeric date", name)
+		}
+		seconds = v
+	default:
+		return time.Time{}, false, fmt.Errorf("claim %s is not a numeric date", name)
+	}
+
+	if math.IsNaN(seconds) || seconds < 0 || seconds > maxNumericDate {
+		return time.Time{}, false, fmt.Errorf("claim %s is out of the numeric date range", name)
+	}
+
+	sec, frac := math.Modf(seconds)
+	return time.Unix(int64(sec), int64(frac*float64(time.Second))), true, nil
+}
+
+// checkTimeClaims checks the exp, nbf and iat claims with the allowed clock skew
+func checkTimeClaims(claims Claims, leeway time.Duration) error {
+	now := time.Now()
+
+	exp, ok, err := numericDate(claims, "exp")
+	if err != nil {
+		return &ValidationError{Reason: ReasonInvalidToken, Err: err}
+	}
+	if ok && now.After(exp.Add(leeway)) {
+		return &ValidationError{Reason: ReasonTokenExpired}
+	}
+
+	for _, name := range []string{"nbf", "iat"} {
+		date, ok, err := numericDate(claims, name)
+		if err != nil {
+			return &ValidationError{Reason: ReasonInvalidToken, Err: err}
+		}
+		if ok && now.Add(leeway).Before(date) {
+			return &ValidationError{Reason: ReasonTokenNotValid}
+		}
+	}
+
+	return nil
+}
+
+// checkIssuer checks that the iss claim is one of the expected issuers
+func checkIssuer(claims Claims, issuers []string) error {
+	if len(issuers) == 0 {
+		return nil
+	}
+
+	iss, _ := claims["iss"].(string)
+	if !containsAny([]string{iss}, issuers) {
+		return &ValidationError{Reason: ReasonInvalidIssuer, Err: fmt.Errorf("issuer %q is not expected", iss)}
+	}
+
+	return nil
+}
+
+// checkAudience checks that the aud claim contains one of the expected audiences
+func checkAudience(claims Claims, audiences []string) error {
+	if len(audiences) == 0 {
+		return nil
+	}
+
+	if !containsAny(claimValues(claims["aud"]), audiences) {
+		return &ValidationError{Reason: ReasonInvalidAudience}
+	}
+
+	return nil
+}
+
+// defaultScopeClaims are the claims with the scopes of the token: the space
+// separated scope string (RFC 8693) and the scp array
+var defaultScopeClaims = []string{"scope", "scp"}
+
+// tokenScopes returns the scopes of the scope claims. The claim value could be
+// the space separated string or the array of scopes.
+func tokenScopes(claims Claims, scopeClaims []string) ([]string, bool) {
+	if len(scopeClaims) == 0 {
+		scopeClaims = defaultScopeClaims
+	}
+
+	var scopes []string
+	found := false
+
+	for _, name := range scopeClaims {
+		values := claims.Values(name)
+		if values == nil {
+			continue
+		}
+		found = true
+
+		for _, value := range values {
+			scopes = append(scopes, strings.Fields(value)...)
+		}
+	}
+
+	return scopes, found
+}
+
+// checkScopes checks that the scopes of the token contain all scopes
+func checkScopes(tokenScopes []string, scopes []string) error {
+	for _, scope := range scopes {
+		found := false
+		for _, scopeInToken := range tokenScopes {
+			if strings.EqualFold(scope, scopeInToken) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return &ValidationError{Reason: ReasonMissingScope, Err: fmt.Errorf("token doesn't contain a necessary scope %s", scope)}
+		}
+	}
+
+	return nil
+}
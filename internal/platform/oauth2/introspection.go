@@ -2,10 +2,18 @@ package oauth2
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"net/url"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/karlseguin/ccache/v2"
 	"github.com/pkg/errors"
@@ -15,73 +23,271 @@ import (
 	"github.com/wallarm/api-firewall/internal/config"
 )
 
+const (
+	defaultIntrospectionTimeout = 5 * time.Second
+	introspectionRetryDelay     = 100 * time.Millisecond
+
+	// introspectionFailureTTL is the time the introspection endpoint is not
+	// requested after the failed request, so the outage of the endpoint
+	// doesn't stall every request
+	introspectionFailureTTL = 5 * time.Second
+)
+
 type Introspection struct {
+	// unavailableUntil is the time (unix nanoseconds) until the endpoint is
+	// considered unavailable after the failed request. It is the first field
+	// for the 64-bit alignment of the atomic operations.
+	unavailableUntil int64
+
 	Cfg    *config.Oauth
 	Logger *logrus.Logger
 	Cache  *ccache.Cache
+	Client *fasthttp.Client
+
+	// calls are the running introspection requests by the token, the
+	// concurrent requests with the same token share the single call
+	mutex sync.Mutex
+	calls map[string]*introspectionCall
+}
+
+// introspectionCall is the introspection request shared by the concurrent
+// requests with the same token
+type introspectionCall struct {
+	done chan struct{}
+	meta map[string]interface{}
+	err  error
 }
 
-func (i *Introspection) Validate(ctx context.Context, tokenWithBearer string, scopes []string) error {
+// NewIntrospection creates the validator with the dedicated client of the
+// introspection endpoint and the bounded cache of the token statuses
+func NewIntrospection(cfg *config.Oauth, logger *logrus.Logger) (*Introspection, error) {
+
+	tlsConfig, err := newIntrospectionTLSConfig(&cfg.Introspection)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := introspectionTimeout(&cfg.Introspection)
 
-	// openapi doesn't contain scopes in endpoint configuration
-	if len(scopes) == 0 {
-		return nil
+	cacheConfig := ccache.Configure()
+	if cfg.Introspection.CacheSize > 0 {
+		cacheConfig = cacheConfig.MaxSize(cfg.Introspection.CacheSize)
 	}
 
+	return &Introspection{
+		Cfg:    cfg,
+		Logger: logger,
+		Cache:  ccache.New(cacheConfig),
+		calls:  make(map[string]*introspectionCall),
+		Client: &fasthttp.Client{
+			Dial: func(addr string) (net.Conn, error) {
+				return fasthttp.DialTimeout(addr, timeout)
+			},
+			TLSConfig:    tlsConfig,
+			ReadTimeout:  timeout,
+			WriteTimeout: timeout,
+		},
+	}, nil
+}
+
+// introspectionTimeout returns the timeout of the introspection including
+// the retries
+func introspectionTimeout(cfg *config.Introspection) time.Duration {
+	if cfg.Timeout > 0 {
+		return cfg.Timeout
+	}
+	return defaultIntrospectionTimeout
+}
+
+// newIntrospectionTLSConfig returns the TLS configuration with the system
+// certificates and the custom CA of the introspection endpoint
+func newIntrospectionTLSConfig(cfg *config.Introspection) (*tls.Config, error) {
+
+	rootCAs, err := x509.SystemCertPool()
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.RootCA != "" {
+		certs, err := ioutil.ReadFile(cfg.RootCA)
+		if err != nil {
+			return nil, fmt.Errorf("failed to append %q to RootCAs: %v", cfg.RootCA, err)
+		}
+
+		if ok := rootCAs.AppendCertsFromPEM(certs); !ok {
+			return nil, fmt.Errorf("no certs appended from %q", cfg.RootCA)
+		}
+	}
+
+	return &tls.Config{
+		InsecureSkipVerify: cfg.InsecureConnection,
+		RootCAs:            rootCAs,
+	}, nil
+}
+
+// Validate checks the token status returned by the introspection endpoint
+// (RFC 7662). The status is cached until the token expires but not longer
+// than the refresh interval. Inactive tokens are cached as well.
+func (i *Introspection) Validate(ctx context.Context, tokenWithBearer string, scopes []string) (Claims, error) {
+
 	tokenString := strings.TrimPrefix(tokenWithBearer, "Bearer ")
 
 	if tokenString == "" {
-		return errors.New("oauth token not found")
+		return nil, &ValidationError{Reason: ReasonInvalidToken, Err: errors.New("oauth token not found")}
 	}
 
 	var meta map[string]interface{}
 	var err error
 
 	metaCached := i.Cache.Get(tokenString)
-	switch metaCached {
-	case nil:
-		meta, err = i.getTokenMetaInfo(tokenString)
+	switch {
+	case metaCached == nil || metaCached.Expired():
+		meta, err = i.tokenMetaInfo(ctx, tokenString)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	default:
 		meta = metaCached.Value().(map[string]interface{})
 	}
 
-	scopeString, ok := meta["scope"].(string)
-	if !ok && len(scopes) > 0 {
-		return errors.New("scope field not found in OAuth provider response")
+	if err := i.checkTokenStatus(meta); err != nil {
+		return nil, err
 	}
 
-	scopesInToken := strings.Split(scopeString, " ")
-
-	i.Cache.Set(tokenString, meta, i.Cfg.Introspection.RefreshInterval)
+	if len(scopes) > 0 {
+		tokenScopes, ok := tokenScopes(meta, i.Cfg.ScopeClaims)
+		if !ok {
+			return nil, &ValidationError{Reason: ReasonMissingScope, Err: errors.New("scope field not found in OAuth provider response")}
+		}
 
-	for _, scope := range scopes {
-		scopeFound := false
-		for _, scopeInToken := range scopesInToken {
-			if scope == scopeInToken {
-				scopeFound = true
-				break
-			}
+		if err := checkScopes(tokenScopes, scopes); err != nil {
+			return nil, err
 		}
-		if !scopeFound {
-			return errors.New("token doesn't contain a necessary scope")
+	}
+
+	return meta, nil
+}
+
+// checkTokenStatus checks that the token is active, not expired and issued
+// to one of the allowed clients
+func (i *Introspection) checkTokenStatus(meta map[string]interface{}) error {
+	if active, _ := meta["active"].(bool); !active {
+		return &ValidationError{Reason: ReasonTokenInactive}
+	}
+
+	if err := checkTimeClaims(meta, 0); err != nil {
+		return err
+	}
+
+	if len(i.Cfg.Introspection.ClientIDs) > 0 {
+		clientID, _ := meta["client_id"].(string)
+		if !containsAny([]string{clientID}, i.Cfg.Introspection.ClientIDs) {
+			return &ValidationError{Reason: ReasonInvalidClient, Err: fmt.Errorf("client %q is not allowed", clientID)}
 		}
 	}
 
 	return nil
 }
 
-func (i *Introspection) getTokenMetaInfo(token string) (map[string]interface{}, error) {
+// cacheTTL returns the cache duration of the token status. The status of the
+// active token is cached until the token expires.
+func (i *Introspection) cacheTTL(meta map[string]interface{}) time.Duration {
+	ttl := i.Cfg.Introspection.RefreshInterval
+
+	if active, _ := meta["active"].(bool); !active {
+		return ttl
+	}
+
+	if exp, ok, err := numericDate(meta, "exp"); err == nil && ok {
+		if untilExp := time.Until(exp); untilExp > 0 && untilExp < ttl {
+			ttl = untilExp
+		}
+	}
+
+	return ttl
+}
+
+// deadline returns the deadline of the introspection of the request. The
+// introspection takes not longer than the timeout and the deadline of the
+// request context.
+func (i *Introspection) deadline(ctx context.Context) time.Time {
+	deadline := time.Now().Add(introspectionTimeout(&i.Cfg.Introspection))
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	return deadline
+}
+
+// tokenMetaInfo returns the token status from the introspection endpoint and
+// caches it. The concurrent requests with the same token share the single
+// introspection request. The endpoint is not requested for the failure TTL
+// after the failed request.
+func (i *Introspection) tokenMetaInfo(ctx context.Context, token string) (map[string]interface{}, error) {
+	if time.Now().UnixNano() < atomic.LoadInt64(&i.unavailableUntil) {
+		return nil, &ValidationError{Reason: ReasonProviderUnavailable, Err: errors.New("introspection endpoint is unavailable")}
+	}
+
+	deadline := i.deadline(ctx)
+
+	i.mutex.Lock()
+	if call, ok := i.calls[token]; ok {
+		i.mutex.Unlock()
+
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+
+		select {
+		case <-call.done:
+			return call.meta, call.err
+		case <-timer.C:
+			return nil, &ValidationError{Reason: ReasonProviderUnavailable, Err: errors.New("introspection request timed out")}
+		}
+	}
+
+	call := &introspectionCall{done: make(chan struct{})}
+	i.calls[token] = call
+	i.mutex.Unlock()
+
+	call.meta, call.err = i.getTokenMetaInfo(token, deadline)
+
+	var validationErr *ValidationError
+	switch {
+	case call.err == nil:
+		i.Cache.Set(token, call.meta, i.cacheTTL(call.meta))
+	case errors.As(call.err, &validationErr) && validationErr.Reason == ReasonProviderUnavailable:
+		atomic.StoreInt64(&i.unavailableUntil, time.Now().Add(introspectionFailureTTL).UnixNano())
+	}
+
+	i.mutex.Lock()
+	delete(i.calls, token)
+	i.mutex.Unlock()
+
+	close(call.done)
+
+	return call.meta, call.err
+}
+
+func (i *Introspection) getTokenMetaInfo(token string, deadline time.Time) (map[string]interface{}, error) {
 
 	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+
 	req.Header.SetMethod(i.Cfg.Introspection.EndpointMethod)
 
 	parsedEndpointUrl, err := url.Parse(i.Cfg.Introspection.Endpoint)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse introspection endpoint url: %v", err)
 	}
+
+	authMethod := strings.ToLower(i.Cfg.Introspection.ClientAuthMethod)
+
+	// client credentials are sent as the request parameters
+	var clientParams string
+	if authMethod == "client_secret_post" {
+		clientParams = fmt.Sprintf("client_id=%s&client_secret=%s",
+			url.QueryEscape(i.Cfg.Introspection.ClientID), url.QueryEscape(i.Cfg.Introspection.ClientSecret))
+	}
+
 	switch strings.ToLower(i.Cfg.Introspection.EndpointMethod) {
 	case "post":
 		if i.Cfg.Introspection.TokenParamName != "" {
@@ -94,6 +300,12 @@ func (i *Introspection) getTokenMetaInfo(token string) (map[string]interface{},
 				req.SetBodyString(i.Cfg.Introspection.EndpointParams)
 			}
 		}
+		if clientParams != "" {
+			if len(req.Body()) > 0 {
+				req.AppendBodyString("&")
+			}
+			req.AppendBodyString(clientParams)
+		}
 	case "get":
 		if i.Cfg.Introspection.EndpointParams != "" {
 			parsedEndpointUrl.RawQuery = i.Cfg.Introspection.EndpointParams
@@ -105,14 +317,26 @@ func (i *Introspection) getTokenMetaInfo(token string) (map[string]interface{},
 			parsedEndpointUrl.RawQuery = reqQuery.Encode()
 		}
 
+		if clientParams != "" {
+			if parsedEndpointUrl.RawQuery != "" {
+				parsedEndpointUrl.RawQuery += "&"
+			}
+			parsedEndpointUrl.RawQuery += clientParams
+		}
+
 	}
 
 	t := parsedEndpointUrl.String()
 	req.SetRequestURI(t)
 
-	if i.Cfg.Introspection.ClientAuthBearerToken == "" {
+	switch {
+	case authMethod == "client_secret_basic":
+		credentials := url.QueryEscape(i.Cfg.Introspection.ClientID) + ":" + url.QueryEscape(i.Cfg.Introspection.ClientSecret)
+		req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)))
+	case authMethod == "client_secret_post":
+	case i.Cfg.Introspection.ClientAuthBearerToken == "":
 		req.Header.Set("Authorization", "Bearer "+token)
-	} else {
+	default:
 		req.Header.Set("Authorization", "Bearer "+i.Cfg.Introspection.ClientAuthBearerToken)
 	}
 
@@ -122,10 +346,11 @@ func (i *Introspection) getTokenMetaInfo(token string) (map[string]interface{},
 	}
 
 	res := fasthttp.AcquireResponse()
-	if err := fasthttp.Do(req, res); err != nil {
-		return nil, fmt.Errorf("failed to send introspection request: %v", err)
+	defer fasthttp.ReleaseResponse(res)
+
+	if err := i.do(req, res, deadline); err != nil {
+		return nil, &ValidationError{Reason: ReasonProviderUnavailable, Err: err}
 	}
-	fasthttp.ReleaseRequest(req)
 
 	body := res.Body()
 
@@ -134,7 +359,31 @@ func (i *Introspection) getTokenMetaInfo(token string) (map[string]interface{},
 		return nil, fmt.Errorf("failed to unmarshal extension properties: %v (%s)", err, body)
 	}
 
-	fasthttp.ReleaseResponse(res)
-
 	return tokenStatus, nil
 }
+
+// do sends the introspection request. The request is retried on the network
+// errors and the server errors of the introspection endpoint until the
+// deadline.
+func (i *Introspection) do(req *fasthttp.Request, res *fasthttp.Response, deadline time.Time) error {
+	for attempt := 0; ; attempt++ {
+		err := i.Client.DoDeadline(req, res, deadline)
+		if err == nil {
+			if res.StatusCode() == fasthttp.StatusOK {
+				return nil
+			}
+			err = fmt.Errorf("introspection endpoint responded with status code %d", res.StatusCode())
+			if res.StatusCode() < 500 && res.StatusCode() != fasthttp.StatusTooManyRequests {
+				return err
+			}
+		}
+
+		// the retry after the delay doesn't fit the deadline
+		if attempt >= i.Cfg.Introspection.Retries || time.Until(deadline) <= introspectionRetryDelay {
+			return fmt.Errorf("failed to send introspection request: %v", err)
+		}
+
+		i.Logger.Debugf("OAuth2: introspection request failed, retrying: %s", err)
+		time.Sleep(introspectionRetryDelay)
+	}
+}
@@ -0,0 +1,169 @@
+package oauth2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/wallarm/api-firewall/internal/config"
+)
+
+// testIntrospectionEndpoint is the introspection endpoint which responds
+// with the status after the delay
+type testIntrospectionEndpoint struct {
+	*httptest.Server
+
+	status   int32
+	requests int32
+}
+
+func newTestIntrospectionEndpoint(t *testing.T, delay time.Duration) *testIntrospectionEndpoint {
+	t.Helper()
+
+	e := testIntrospectionEndpoint{status: http.StatusOK}
+	e.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&e.requests, 1)
+		time.Sleep(delay)
+
+		status := int(atomic.LoadInt32(&e.status))
+		w.WriteHeader(status)
+		if status == http.StatusOK {
+			fmt.Fprintf(w, `{"active":true,"sub":"user","exp":%d}`, time.Now().Add(time.Hour).Unix())
+		}
+	}))
+	t.Cleanup(e.Close)
+
+	return &e
+}
+
+func newTestIntrospection(t *testing.T, endpoint string, timeout time.Duration, retries int) *Introspection {
+	t.Helper()
+
+	introspection, err := NewIntrospection(&config.Oauth{
+		ValidationType: "introspection",
+		Introspection: config.Introspection{
+			Endpoint:         endpoint,
+			EndpointMethod:   "GET",
+			TokenParamName:   "token",
+			ClientAuthMethod: "BEARER",
+			RefreshInterval:  time.Minute,
+			Timeout:          timeout,
+			Retries:          retries,
+		},
+	}, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(introspection.Cache.Stop)
+
+	return introspection
+}
+
+func TestIntrospectionSingleRequest(t *testing.T) {
+
+	endpoint := newTestIntrospectionEndpoint(t, 100*time.Millisecond)
+	introspection := newTestIntrospection(t, endpoint.URL, time.Second, 0)
+
+	// the concurrent requests with the same token share the single introspection
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			claims, err := introspection.Validate(context.Background(), "Bearer token", nil)
+			if err == nil && claims["sub"] != "user" {
+				err = fmt.Errorf("incorrect claims: %v", claims)
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Token validation failed: %s", err)
+		}
+	}
+
+	if n := atomic.LoadInt32(&endpoint.requests); n != 1 {
+		t.Errorf("Incorrect number of the introspection requests. Expected: 1 and got %d", n)
+	}
+}
+
+func TestIntrospectionDeadline(t *testing.T) {
+
+	endpoint := newTestIntrospectionEndpoint(t, 300*time.Millisecond)
+	atomic.StoreInt32(&endpoint.status, http.StatusServiceUnavailable)
+
+	// the retries don't extend the introspection beyond the timeout
+	introspection := newTestIntrospection(t, endpoint.URL, 500*time.Millisecond, 5)
+
+	start := time.Now()
+	_, err := introspection.Validate(context.Background(), "Bearer token", nil)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Introspection took %s with the timeout of 500ms", elapsed)
+	}
+
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) || validationErr.Reason != ReasonProviderUnavailable {
+		t.Errorf("Unexpected error of the unavailable endpoint: %v", err)
+	}
+
+	// the deadline of the request context is shorter than the timeout
+	introspection = newTestIntrospection(t, endpoint.URL, 5*time.Second, 5)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start = time.Now()
+	if _, err := introspection.Validate(ctx, "Bearer token", nil); err == nil {
+		t.Error("Token is validated by the unavailable endpoint")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Introspection took %s with the request deadline of 200ms", elapsed)
+	}
+}
+
+func TestIntrospectionUnavailable(t *testing.T) {
+
+	endpoint := newTestIntrospectionEndpoint(t, 0)
+	atomic.StoreInt32(&endpoint.status, http.StatusInternalServerError)
+
+	introspection := newTestIntrospection(t, endpoint.URL, time.Second, 1)
+
+	if _, err := introspection.Validate(context.Background(), "Bearer first", nil); err == nil {
+		t.Fatal("Token is validated by the unavailable endpoint")
+	}
+	requests := atomic.LoadInt32(&endpoint.requests)
+
+	// the endpoint is not requested again right after the failure
+	atomic.StoreInt32(&endpoint.status, http.StatusOK)
+
+	_, err := introspection.Validate(context.Background(), "Bearer second", nil)
+
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) || validationErr.Reason != ReasonProviderUnavailable {
+		t.Errorf("Unexpected error of the unavailable endpoint: %v", err)
+	}
+
+	if n := atomic.LoadInt32(&endpoint.requests); n != requests {
+		t.Errorf("Introspection endpoint is requested during the outage: %d requests", n-requests)
+	}
+
+	// the endpoint is requested after the failure TTL
+	atomic.StoreInt64(&introspection.unavailableUntil, time.Now().UnixNano())
+
+	if _, err := introspection.Validate(context.Background(), "Bearer second", nil); err != nil {
+		t.Errorf("Token validation failed: %s", err)
+	}
+}
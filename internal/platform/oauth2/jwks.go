@@ -0,0 +1,340 @@
+package oauth2
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+)
+
+const providerRequestTimeout = 10 * time.Second
+
+// jwk is the public key of the JWK set
+type jwk struct {
+	key crypto.PublicKey
+	alg string
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// JWKS is the set of the public keys loaded from the JWKS URL or file. The
+// keys are refreshed after the refresh interval or when the token is signed
+// by the unknown key. The unknown keys trigger the refresh not more often
+// than once per the min refresh interval.
+type JWKS struct {
+	location           *url.URL
+	refreshInterval    time.Duration
+	minRefreshInterval time.Duration
+	logger             *logrus.Logger
+
+	mutex       sync.RWMutex
+	keys        map[string]jwk
+	lastRefresh time.Time
+
+	// refreshMutex serializes the refreshes caused by the unknown keys
+	refreshMutex sync.Mutex
+
+	// refreshing is set while the background refresh is in progress
+	refreshing int32
+
+	// closeMutex guards the closed flag and the start of the background
+	// refreshes, which are waited for by Close
+	closeMutex sync.Mutex
+	closed     bool
+	refreshes  sync.WaitGroup
+}
+
+// NewJWKS creates the JWK set and loads the keys. The keys are loaded again
+// on demand if the initial load fails.
+func NewJWKS(location string, refreshInterval, minRefreshInterval time.Duration, logger *logrus.Logger) (*JWKS, error) {
+	jwksLocation, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse JWKS location: %v", err)
+	}
+
+	if jwksLocation.Scheme == "" || jwksLocation.Host == "" {
+		jwksLocation = &url.URL{Path: location}
+	}
+
+	jwks := JWKS{
+		location:           jwksLocation,
+		refreshInterval:    refreshInterval,
+		minRefreshInterval: minRefreshInterval,
+		logger:             logger,
+		keys:               make(map[string]jwk),
+	}
+
+	if err := jwks.refresh(); err != nil {
+		logger.Errorf("OAuth2: JWKS: %s", err)
+	}
+
+	return &jwks, nil
+}
+
+// Key returns the key with the kid. If the kid is empty and the set contains
+// the single key, that key is returned.
+func (j *JWKS) Key(kid string) (crypto.PublicKey, string, error) {
+	j.mutex.RLock()
+	key, found := j.lookup(kid)
+	stale := time.Since(j.lastRefresh) > j.refreshInterval
+	canRefresh := time.Since(j.lastRefresh) > j.minRefreshInterval
+	j.mutex.RUnlock()
+
+	switch {
+	case !found && canRefresh:
+		// the key could be rotated by the identity provider
+		if err := j.refreshUnknown(); err != nil {
+			return nil, "", err
+		}
+
+		j.mutex.RLock()
+		key, found = j.lookup(kid)
+		j.mutex.RUnlock()
+	case stale:
+		j.backgroundRefresh()
+	}
+
+	if !found {
+		return nil, "", fmt.Errorf("key %q not found in JWKS", kid)
+	}
+
+	return key.key, key.alg, nil
+}
+
+func (j *JWKS) lookup(kid string) (jwk, bool) {
+	if kid == "" && len(j.keys) == 1 {
+		for _, key := range j.keys {
+			return key, true
+		}
+	}
+
+	key, ok := j.keys[kid]
+	return key, ok
+}
+
+// refreshUnknown refreshes the keys once for the concurrent requests with
+// the unknown keys
+func (j *JWKS) refreshUnknown() error {
+	j.refreshMutex.Lock()
+	defer j.refreshMutex.Unlock()
+
+	j.mutex.RLock()
+	canRefresh := time.Since(j.lastRefresh) > j.minRefreshInterval
+	j.mutex.RUnlock()
+
+	if !canRefresh {
+		return nil
+	}
+
+	return j.refresh()
+}
+
+// backgroundRefresh starts the refresh of the keys in the background unless
+// the refresh is in progress or the set is closed
+func (j *JWKS) backgroundRefresh() {
+	j.closeMutex.Lock()
+	defer j.closeMutex.Unlock()
+
+	if j.closed || !atomic.CompareAndSwapInt32(&j.refreshing, 0, 1) {
+		return
+	}
+
+	j.refreshes.Add(1)
+	go func() {
+		defer j.refreshes.Done()
+		defer atomic.StoreInt32(&j.refreshing, 0)
+
+		if err := j.refresh(); err != nil {
+			j.logger.Errorf("OAuth2: JWKS: %s", err)
+		}
+	}()
+}
+
+// Close stops the background refreshes of the keys and waits for the
+// running refresh
+func (j *JWKS) Close() {
+	j.closeMutex.Lock()
+	j.closed = true
+	j.closeMutex.Unlock()
+
+	j.refreshes.Wait()
+}
+
+// refresh loads the keys. The current keys are kept if the load fails.
+func (j *JWKS) refresh() error {
+	data, err := j.read()
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	j.lastRefresh = time.Now()
+
+	if err != nil {
+		return err
+	}
+
+	keys, err := parseJWKS(data, j.logger)
+	if err != nil {
+		return err
+	}
+
+	j.keys = keys
+	j.logger.Debugf("OAuth2: JWKS: %d keys loaded", len(keys))
+
+	return nil
+}
+
+func (j *JWKS) read() ([]byte, error) {
+	if j.location.Host == "" {
+		return ioutil.ReadFile(j.location.Path)
+	}
+
+	return fetch(j.location.String(), "JWKS")
+}
+
+// fetch sends the GET request to the identity provider
+func fetch(uri, name string) ([]byte, error) {
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.SetRequestURI(uri)
+
+	if err := fasthttp.DoTimeout(req, resp, providerRequestTimeout); err != nil {
+		return nil, fmt.Errorf("failed to send %s request: %v", name, err)
+	}
+
+	if resp.StatusCode() != fasthttp.StatusOK {
+		return nil, fmt.Errorf("failed to get %s: status code %d", name, resp.StatusCode())
+	}
+
+	body := make([]byte, len(resp.Body()))
+	copy(body, resp.Body())
+
+	return body, nil
+}
+
+// parseJWKS parses the RSA, EC and OKP (Ed25519) public keys of the JWK set.
+// The keys for the encryption and the unsupported keys are skipped.
+func parseJWKS(data []byte, logger *logrus.Logger) (map[string]jwk, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("failed to parse JWKS: %v", err)
+	}
+
+	keys := make(map[string]jwk, len(set.Keys))
+
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		key, err := k.publicKey()
+		if err != nil {
+			logger.Errorf("OAuth2: JWKS: key %q skipped: %s", k.Kid, err)
+			continue
+		}
+
+		keys[k.Kid] = jwk{key: key, alg: k.Alg}
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("no signing keys found in JWKS")
+	}
+
+	return keys, nil
+}
+
+func (k *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key size")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	if value == "" {
+		return nil, errors.New("missing key parameter")
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return new(big.Int).SetBytes(data), nil
+}
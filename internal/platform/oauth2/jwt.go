@@ -2,7 +2,7 @@ package oauth2
 
 import (
 	"context"
-	"crypto/rsa"
+	"crypto"
 	"fmt"
 	"strings"
 
@@ -16,30 +16,101 @@ import (
 type JWT struct {
 	Cfg       *config.Oauth
 	Logger    *logrus.Logger
-	PubKey    *rsa.PublicKey
+	PubKey    crypto.PublicKey
 	SecretKey []byte
+	JWKS      *JWKS
+
+	// RequiredClaims are checked for all tokens
+	RequiredClaims ClaimRequirements
+}
+
+// signingMethodFamily returns the family of the signing algorithm: RS, PS,
+// ES, HS or EdDSA
+func signingMethodFamily(alg string) string {
+	if strings.EqualFold(alg, "EdDSA") {
+		return "EdDSA"
+	}
+	if len(alg) < 2 {
+		return ""
+	}
+	return strings.ToUpper(alg[:2])
 }
 
-func (j *JWT) Validate(ctx context.Context, tokenWithBearer string, scopes []string) error {
+// checkSigningMethod checks that the token is signed by the method of the family
+func checkSigningMethod(token *jwt.Token, family string) error {
+	var ok bool
 
-	tokenString := strings.TrimPrefix(tokenWithBearer, "Bearer ")
+	switch family {
+	case "RS":
+		_, ok = token.Method.(*jwt.SigningMethodRSA)
+	case "PS":
+		_, ok = token.Method.(*jwt.SigningMethodRSAPSS)
+	case "ES":
+		_, ok = token.Method.(*jwt.SigningMethodECDSA)
+	case "EdDSA":
+		_, ok = token.Method.(*jwt.SigningMethodEd25519)
+	case "HS":
+		_, ok = token.Method.(*jwt.SigningMethodHMAC)
+	}
+
+	if !ok {
+		return errors.New("unknown signing method")
+	}
+
+	return nil
+}
+
+// jwksKey returns the key of the JWK set selected by the kid of the token.
+// The algorithm of the token should match the algorithm of the key.
+func (j *JWT) jwksKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	key, alg, err := j.JWKS.Key(kid)
+	if err != nil {
+		return nil, err
+	}
 
-	type MyCustomClaims struct {
-		Scope string `json:"scope"`
-		jwt.StandardClaims
+	if alg != "" && alg != token.Method.Alg() {
+		return nil, fmt.Errorf("token algorithm %s doesn't match key algorithm %s", token.Method.Alg(), alg)
 	}
 
-	token, err := jwt.ParseWithClaims(tokenString, &MyCustomClaims{}, func(token *jwt.Token) (interface{}, error) {
+	family := signingMethodFamily(token.Method.Alg())
+	if family == "HS" {
+		return nil, errors.New("unknown signing method")
+	}
+
+	if err := checkSigningMethod(token, family); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
 
-		switch j.Cfg.JWT.SignatureAlgorithm {
-		case "RS256", "RS384", "RS512":
-			if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
-				return nil, errors.New("unknown signing method")
+func (j *JWT) Validate(ctx context.Context, tokenWithBearer string, scopes []string) (Claims, error) {
+
+	tokenString := strings.TrimPrefix(tokenWithBearer, "Bearer ")
+
+	// the time claims are validated with the leeway after the signature check
+	parser := jwt.Parser{SkipClaimsValidation: true}
+	claims := jwt.MapClaims{}
+
+	token, err := parser.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+
+		if j.JWKS != nil {
+			return j.jwksKey(token)
+		}
+
+		family := signingMethodFamily(j.Cfg.JWT.SignatureAlgorithm)
+
+		switch family {
+		case "RS", "PS", "ES", "EdDSA":
+			if err := checkSigningMethod(token, family); err != nil {
+				return nil, err
 			}
 			return j.PubKey, nil
-		case "HS256", "HS384", "HS512":
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, errors.New("unknown signing method")
+		case "HS":
+			if err := checkSigningMethod(token, family); err != nil {
+				return nil, err
 			}
 			return j.SecretKey, nil
 		}
@@ -48,30 +119,37 @@ func (j *JWT) Validate(ctx context.Context, tokenWithBearer string, scopes []str
 	})
 
 	if err != nil {
-		return fmt.Errorf("oauth2 token invalid: %s", err)
+		return nil, &ValidationError{Reason: ReasonInvalidToken, Err: err}
 	}
 
-	claims, ok := token.Claims.(*MyCustomClaims)
-	if ok && token.Valid {
-		j.Logger.Debugf("%v %v", claims.Scope, claims.StandardClaims.ExpiresAt)
-	} else {
-		return errors.New("oauth2 token invalid")
+	if !token.Valid {
+		return nil, &ValidationError{Reason: ReasonInvalidToken}
 	}
 
-	scopesInToken := strings.Split(strings.ToLower(claims.Scope), " ")
+	tokenClaims := Claims(claims)
 
-	for _, scope := range scopes {
-		scopeFound := false
-		for _, scopeInToken := range scopesInToken {
-			if strings.ToLower(scope) == scopeInToken {
-				scopeFound = true
-				break
-			}
-		}
-		if !scopeFound {
-			return errors.New("token doesn't contain a necessary scope")
-		}
+	if err := checkTimeClaims(tokenClaims, j.Cfg.JWT.Leeway); err != nil {
+		return nil, err
 	}
 
-	return nil
+	if err := checkIssuer(tokenClaims, j.Cfg.JWT.Issuers); err != nil {
+		return nil, err
+	}
+
+	if err := checkAudience(tokenClaims, j.Cfg.JWT.Audiences); err != nil {
+		return nil, err
+	}
+
+	if err := CheckClaims(tokenClaims, j.RequiredClaims); err != nil {
+		return nil, err
+	}
+
+	tokenScopes, _ := tokenScopes(tokenClaims, j.Cfg.ScopeClaims)
+	j.Logger.Debugf("%v %v", tokenScopes, tokenClaims["exp"])
+
+	if err := checkScopes(tokenScopes, scopes); err != nil {
+		return nil, err
+	}
+
+	return tokenClaims, nil
 }
@@ -2,8 +2,92 @@ package oauth2
 
 import (
 	"context"
+	"crypto"
+	"io/ioutil"
+	"strings"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/wallarm/api-firewall/internal/config"
 )
 
+// OAuth2 validates the token and returns its claims
 type OAuth2 interface {
-	Validate(ctx context.Context, tokenWithBearer string, scopes []string) error
+	Validate(ctx context.Context, tokenWithBearer string, scopes []string) (Claims, error)
+}
+
+// New creates the validator of the validation type of the configuration. It
+// returns nil if the validation type is not set. The introspection validator
+// should be stopped by Stop.
+func New(cfg *config.Oauth, logger *logrus.Logger) (OAuth2, error) {
+	switch strings.ToLower(cfg.ValidationType) {
+	case "jwt":
+		// keys are selected by the kid of the token from the JWK set
+		if cfg.JWT.JWKS != "" {
+			jwks, err := NewJWKS(cfg.JWT.JWKS, cfg.JWT.JWKSRefreshInterval, cfg.JWT.JWKSMinRefreshInterval, logger)
+			if err != nil {
+				return nil, errors.Wrap(err, "initializing JWKS")
+			}
+
+			return &JWT{
+				Cfg:            cfg,
+				Logger:         logger,
+				JWKS:           jwks,
+				RequiredClaims: ParseClaimRequirements(cfg.JWT.RequiredClaims),
+			}, nil
+		}
+
+		var key crypto.PublicKey
+		if alg := strings.ToLower(cfg.JWT.SignatureAlgorithm); !strings.HasPrefix(alg, "hs") {
+			verifyBytes, err := ioutil.ReadFile(cfg.JWT.PubCertFile)
+			if err != nil {
+				return nil, errors.Wrap(err, "reading public key from file")
+			}
+
+			switch {
+			case strings.HasPrefix(alg, "es"):
+				key, err = jwt.ParseECPublicKeyFromPEM(verifyBytes)
+			case alg == "eddsa":
+				key, err = jwt.ParseEdPublicKeyFromPEM(verifyBytes)
+			default:
+				key, err = jwt.ParseRSAPublicKeyFromPEM(verifyBytes)
+			}
+			if err != nil {
+				return nil, errors.Wrap(err, "parsing public key")
+			}
+
+			logger.Infof("OAuth2: public certificate successfully loaded")
+		}
+
+		return &JWT{
+			Cfg:            cfg,
+			Logger:         logger,
+			PubKey:         key,
+			SecretKey:      []byte(cfg.JWT.SecretKey),
+			RequiredClaims: ParseClaimRequirements(cfg.JWT.RequiredClaims),
+		}, nil
+
+	case "introspection":
+		introspection, err := NewIntrospection(cfg, logger)
+		if err != nil {
+			return nil, errors.Wrap(err, "initializing introspection")
+		}
+		return introspection, nil
+	}
+
+	return nil, nil
+}
+
+// Stop stops the background work of the validator
+func Stop(validator OAuth2) {
+	switch validator := validator.(type) {
+	case *Introspection:
+		validator.Cache.Stop()
+	case *JWT:
+		if validator.JWKS != nil {
+			validator.JWKS.Close()
+		}
+	}
 }
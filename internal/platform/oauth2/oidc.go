@@ -0,0 +1,246 @@
+package oauth2
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/wallarm/api-firewall/internal/config"
+)
+
+type discoveryDocument struct {
+	Issuer  string `json:"issuer"`
+	JWKSURI string `json:"jwks_uri"`
+}
+
+// discoveryPath is the path of the discovery document relative to the issuer
+const discoveryPath = "/.well-known/openid-configuration"
+
+// OIDC validates the JWT tokens issued by the OpenID provider. The issuer
+// and the JWKS URI of the provider are loaded from the discovery document.
+type OIDC struct {
+	discoveryURL string
+	cfg          *config.Oauth
+	logger       *logrus.Logger
+
+	// validator is the *JWT built from the discovery document, it is read
+	// without the lock once the document is loaded
+	validator atomic.Value
+
+	// mutex guards the state of the discovery, it is not held while the
+	// discovery document is being loaded
+	mutex       sync.Mutex
+	lastAttempt time.Time
+	lastErr     error
+	closed      bool
+
+	// loading is closed when the running discovery is completed
+	loading chan struct{}
+
+	// discoveries are waited for by Close
+	discoveries sync.WaitGroup
+}
+
+// NewOIDC creates the validator of the OpenID provider. The discovery
+// document is loaded in the background and loaded again on demand if the
+// initial load fails.
+func NewOIDC(discoveryURL string, cfg *config.Oauth, logger *logrus.Logger) *OIDC {
+	oidc := OIDC{
+		discoveryURL: discoveryURL,
+		cfg:          cfg,
+		logger:       logger,
+	}
+
+	oidc.discoveries.Add(1)
+	go func() {
+		defer oidc.discoveries.Done()
+
+		if _, err := oidc.jwt(context.Background()); err != nil {
+			logger.Errorf("OAuth2: OIDC: %s", err)
+		}
+	}()
+
+	return &oidc
+}
+
+// Providers keeps the OpenID providers by the discovery URL. The providers
+// are shared by the handlers built from the versions of the API spec, so the
+// discovery documents and the keys are not loaded again on the spec reload.
+type Providers struct {
+	cfg    *config.Oauth
+	logger *logrus.Logger
+
+	mutex     sync.Mutex
+	providers map[string]*OIDC
+}
+
+func NewProviders(cfg *config.Oauth, logger *logrus.Logger) *Providers {
+	return &Providers{
+		cfg:       cfg,
+		logger:    logger,
+		providers: make(map[string]*OIDC),
+	}
+}
+
+// Provider returns the validator of the provider of the discovery URL. The
+// validator is created on the first call.
+func (p *Providers) Provider(discoveryURL string) *OIDC {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if oidc, ok := p.providers[discoveryURL]; ok {
+		return oidc
+	}
+
+	p.logger.Infof("OAuth2: OIDC: initializing provider %s", discoveryURL)
+
+	oidc := NewOIDC(discoveryURL, p.cfg, p.logger)
+	p.providers[discoveryURL] = oidc
+
+	return oidc
+}
+
+// Close stops the background work of all providers
+func (p *Providers) Close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for _, oidc := range p.providers {
+		oidc.Close()
+	}
+}
+
+// Close waits for the running discovery and stops the background refreshes
+// of the keys of the provider
+func (o *OIDC) Close() {
+	o.mutex.Lock()
+	o.closed = true
+	o.mutex.Unlock()
+
+	o.discoveries.Wait()
+
+	if validator, ok := o.validator.Load().(*JWT); ok {
+		validator.JWKS.Close()
+	}
+}
+
+// jwt returns the validator of the provider. The concurrent requests wait for
+// the single discovery, which is retried not more often than once per the
+// JWKS min refresh interval.
+func (o *OIDC) jwt(ctx context.Context) (*JWT, error) {
+	if validator, ok := o.validator.Load().(*JWT); ok {
+		return validator, nil
+	}
+
+	o.mutex.Lock()
+
+	if validator, ok := o.validator.Load().(*JWT); ok {
+		o.mutex.Unlock()
+		return validator, nil
+	}
+
+	// the discovery is in progress
+	if loading := o.loading; loading != nil {
+		o.mutex.Unlock()
+
+		select {
+		case <-loading:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		if validator, ok := o.validator.Load().(*JWT); ok {
+			return validator, nil
+		}
+
+		o.mutex.Lock()
+		err := o.lastErr
+		o.mutex.Unlock()
+		return nil, err
+	}
+
+	if o.closed {
+		o.mutex.Unlock()
+		return nil, fmt.Errorf("provider %s is closed", o.discoveryURL)
+	}
+
+	if !o.lastAttempt.IsZero() && time.Since(o.lastAttempt) < o.cfg.JWT.JWKSMinRefreshInterval {
+		o.mutex.Unlock()
+		return nil, fmt.Errorf("discovery document of %s is not loaded: %v", o.discoveryURL, o.lastErr)
+	}
+
+	o.lastAttempt = time.Now()
+	loading := make(chan struct{})
+	o.loading = loading
+	o.mutex.Unlock()
+
+	validator, err := o.discover()
+
+	o.mutex.Lock()
+	if err == nil {
+		o.validator.Store(validator)
+	}
+	o.lastErr = err
+	o.loading = nil
+	close(loading)
+	o.mutex.Unlock()
+
+	return validator, err
+}
+
+// discover loads the discovery document and the keys of the provider. The
+// issuer of the document should match the discovery URL (OpenID Connect
+// Discovery 1.0, section 4.3).
+func (o *OIDC) discover() (*JWT, error) {
+	data, err := fetch(o.discoveryURL, "discovery document")
+	if err != nil {
+		return nil, err
+	}
+
+	var doc discoveryDocument
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse discovery document of %s: %v", o.discoveryURL, err)
+	}
+
+	if doc.Issuer == "" || doc.JWKSURI == "" {
+		return nil, errors.Errorf("discovery document of %s doesn't contain issuer or jwks_uri", o.discoveryURL)
+	}
+
+	if strings.TrimSuffix(doc.Issuer, "/")+discoveryPath != o.discoveryURL {
+		return nil, errors.Errorf("issuer %s of the discovery document doesn't match the discovery URL %s", doc.Issuer, o.discoveryURL)
+	}
+
+	jwks, err := NewJWKS(doc.JWKSURI, o.cfg.JWT.JWKSRefreshInterval, o.cfg.JWT.JWKSMinRefreshInterval, o.logger)
+	if err != nil {
+		return nil, err
+	}
+
+	// tokens should be issued by the provider
+	cfg := *o.cfg
+	cfg.JWT.Issuers = []string{doc.Issuer}
+
+	o.logger.Infof("OAuth2: OIDC: provider %s loaded from %s", doc.Issuer, o.discoveryURL)
+
+	return &JWT{
+		Cfg:            &cfg,
+		Logger:         o.logger,
+		JWKS:           jwks,
+		RequiredClaims: ParseClaimRequirements(o.cfg.JWT.RequiredClaims),
+	}, nil
+}
+
+func (o *OIDC) Validate(ctx context.Context, tokenWithBearer string, scopes []string) (Claims, error) {
+	validator, err := o.jwt(ctx)
+	if err != nil {
+		return nil, &ValidationError{Reason: ReasonProviderUnavailable, Err: err}
+	}
+
+	return validator.Validate(ctx, tokenWithBearer, scopes)
+}
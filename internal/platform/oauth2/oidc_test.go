@@ -0,0 +1,178 @@
+package oauth2
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/sirupsen/logrus"
+
+	"github.com/wallarm/api-firewall/internal/config"
+)
+
+// testProvider is the OpenID provider which serves the discovery document
+// and the JWK set of the single EC key
+type testProvider struct {
+	*httptest.Server
+
+	key         *ecdsa.PrivateKey
+	issuer      string
+	discoveries int32
+}
+
+func newTestProvider(t *testing.T, delay time.Duration) *testProvider {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwks, err := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "EC",
+			"kid": "oidc-key",
+			"crv": "P-256",
+			"x":   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+			"y":   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := testProvider{key: key}
+	p.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case discoveryPath:
+			atomic.AddInt32(&p.discoveries, 1)
+			time.Sleep(delay)
+			fmt.Fprintf(w, `{"issuer":%q,"jwks_uri":"%s/jwks"}`, p.issuer, p.URL)
+		case "/jwks":
+			w.Write(jwks)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	p.issuer = p.URL
+	t.Cleanup(p.Close)
+
+	return &p
+}
+
+func (p *testProvider) token(t *testing.T) string {
+	t.Helper()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"iss": p.issuer,
+		"sub": "user",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	token.Header["kid"] = "oidc-key"
+
+	tokenString, err := token.SignedString(p.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return "Bearer " + tokenString
+}
+
+func testOauthConfig() *config.Oauth {
+	return &config.Oauth{
+		ValidationType: "JWT",
+		JWT: config.JWT{
+			JWKSRefreshInterval:    time.Minute,
+			JWKSMinRefreshInterval: time.Minute,
+		},
+	}
+}
+
+func TestOIDCSingleDiscovery(t *testing.T) {
+
+	provider := newTestProvider(t, 100*time.Millisecond)
+
+	oidc := NewOIDC(provider.URL+discoveryPath, testOauthConfig(), logrus.New())
+	defer oidc.Close()
+
+	token := provider.token(t)
+
+	// the concurrent requests to the cold provider share the single discovery
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			claims, err := oidc.Validate(context.Background(), token, nil)
+			if err == nil && claims["sub"] != "user" {
+				err = fmt.Errorf("incorrect claims: %v", claims)
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Token validation failed: %s", err)
+		}
+	}
+
+	if n := atomic.LoadInt32(&provider.discoveries); n != 1 {
+		t.Errorf("Incorrect number of the discovery document requests. Expected: 1 and got %d", n)
+	}
+}
+
+func TestOIDCIssuerMismatch(t *testing.T) {
+
+	provider := newTestProvider(t, 0)
+	provider.issuer = "https://other-issuer.example.com"
+
+	oidc := NewOIDC(provider.URL+discoveryPath, testOauthConfig(), logrus.New())
+	defer oidc.Close()
+
+	_, err := oidc.Validate(context.Background(), provider.token(t), nil)
+
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) || validationErr.Reason != ReasonProviderUnavailable {
+		t.Errorf("Provider with the mismatched issuer has been loaded: %v", err)
+	}
+}
+
+func TestProvidersClose(t *testing.T) {
+
+	provider := newTestProvider(t, 50*time.Millisecond)
+
+	providers := NewProviders(testOauthConfig(), logrus.New())
+
+	oidc := providers.Provider(provider.URL + discoveryPath)
+	if providers.Provider(provider.URL+discoveryPath) != oidc {
+		t.Error("Provider of the same discovery URL is created again")
+	}
+
+	// Close waits for the running discovery, no discoveries are started after it
+	providers.Close()
+	discoveries := atomic.LoadInt32(&provider.discoveries)
+
+	if _, err := oidc.Validate(context.Background(), provider.token(t), nil); err == nil && discoveries == 0 {
+		t.Error("Token is validated by the closed provider")
+	}
+
+	if n := atomic.LoadInt32(&provider.discoveries); n != discoveries {
+		t.Errorf("Discovery document is requested after Close: %d requests", n-discoveries)
+	}
+}
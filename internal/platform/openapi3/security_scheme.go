@@ -125,6 +125,8 @@ func (ss *SecurityScheme) Validate(c context.Context) error {
 		if ss.OpenIdConnectUrl == "" {
 			return fmt.Errorf("no OIDC URL found for openIdConnect security scheme %q", ss.Name)
 		}
+	case "mutualTLS":
+		// OpenAPI 3.1 client certificate authentication
 	default:
 		return fmt.Errorf("security scheme 'type' can't be %q", ss.Type)
 	}
@@ -17,16 +17,24 @@ type ValidationErrorEncoder struct {
 
 // Encode implements the ErrorEncoder interface for encoding ValidationErrors
 func (enc *ValidationErrorEncoder) Encode(ctx context.Context, err error, w http.ResponseWriter) {
-	if e, ok := err.(*routers.RouteError); ok {
-		cErr := convertRouteError(e)
+	if cErr := NewValidationError(err); cErr != nil {
 		enc.Encoder(ctx, cErr, w)
 		return
 	}
+	enc.Encoder(ctx, err, w)
+}
+
+// NewValidationError converts the route or request error to the ValidationError
+// with the details of the failed parameter or request body. It returns nil if
+// the error can't be converted.
+func NewValidationError(err error) *ValidationError {
+	if e, ok := err.(*routers.RouteError); ok {
+		return convertRouteError(e)
+	}
 
 	e, ok := err.(*RequestError)
 	if !ok {
-		enc.Encoder(ctx, err, w)
-		return
+		return nil
 	}
 
 	var cErr *ValidationError
@@ -39,12 +47,7 @@ func (enc *ValidationErrorEncoder) Encode(ctx context.Context, err error, w http
 	} else if innerErr, ok := e.Err.(*openapi3.SchemaError); ok {
 		cErr = convertSchemaError(e, innerErr)
 	}
-
-	if cErr != nil {
-		enc.Encoder(ctx, cErr, w)
-		return
-	}
-	enc.Encoder(ctx, err, w)
+	return cErr
 }
 
 func convertRouteError(e *routers.RouteError) *ValidationError {
@@ -0,0 +1,400 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+
+	"github.com/wallarm/api-firewall/internal/config"
+)
+
+const (
+	RoundRobin       = "ROUND_ROBIN"
+	LeastConnections = "LEAST_CONN"
+	Weighted         = "WEIGHTED"
+)
+
+var errNoHealthyBackends = errors.New("no healthy backends available")
+
+// BackendStatus is the state of the upstream backend reported by the readiness check
+type BackendStatus struct {
+	Host           string `json:"host"`
+	Healthy        bool   `json:"healthy"`
+	ActiveRequests int64  `json:"activeRequests"`
+}
+
+// BackendsReporter is implemented by the pools which spread requests across
+// several backends
+type BackendsReporter interface {
+	Backends() []BackendStatus
+}
+
+type backend struct {
+	host   string
+	weight int
+	pool   Pool
+
+	// number of requests which are being processed by the backend
+	active int64
+
+	// healthClient is used by the active health checks
+	healthClient healthClient
+
+	mutex        sync.Mutex
+	healthy      bool
+	fails        int
+	ejectedUntil time.Time
+
+	// current weight of the smooth weighted round-robin,
+	// guarded by the mutex of the balancedPool
+	currentWeight int
+}
+
+// available returns true if the backend passes the active health checks and
+// it is not ejected because of the failed requests
+func (b *backend) available(now time.Time) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.healthy && !now.Before(b.ejectedUntil)
+}
+
+// healthClient sends the requests of the active health checks
+type healthClient interface {
+	DoTimeout(req *fasthttp.Request, resp *fasthttp.Response, timeout time.Duration) error
+}
+
+// backendClient counts active requests of the backend and reports dial errors
+// for the passive health checks
+type backendClient struct {
+	HTTPClient
+	backend *backend
+	pool    *balancedPool
+}
+
+func (c *backendClient) Do(req *fasthttp.Request, resp *fasthttp.Response) error {
+	atomic.AddInt64(&c.backend.active, 1)
+	err := c.HTTPClient.Do(req, resp)
+	atomic.AddInt64(&c.backend.active, -1)
+
+	c.pool.report(c.backend, err)
+
+	return err
+}
+
+// Pool interface implementation which spreads requests across several
+// backends. Each backend has its own pool of clients.
+type balancedPool struct {
+	backends  []*backend
+	algorithm string
+	server    *config.Server
+	scheme    string
+	logger    *logrus.Logger
+
+	// next is the round-robin counter
+	next uint64
+
+	// mutex guards the state of the weighted balancing
+	mutex sync.Mutex
+
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// BackendHosts returns the host addresses of the backends. The requests are
+// sent to the backends with the scheme and the path of the server URL, so the
+// backends with the other scheme, path, query or fragment are rejected.
+func BackendHosts(serverUrl *url.URL, backends []string) ([]string, error) {
+	hostAddrs := make([]string, 0, len(backends))
+
+	for _, backend := range backends {
+		backendUrl, err := url.ParseRequestURI(backend)
+		if err != nil {
+			return nil, fmt.Errorf("parsing backend URL: %w", err)
+		}
+		if backendUrl.Scheme != serverUrl.Scheme {
+			return nil, fmt.Errorf("scheme of the backend %s doesn't match scheme of the server URL %s", backend, serverUrl)
+		}
+		if path := strings.TrimSuffix(backendUrl.Path, "/"); path != "" && path != strings.TrimSuffix(serverUrl.Path, "/") {
+			return nil, fmt.Errorf("path of the backend %s doesn't match path of the server URL %s", backend, serverUrl)
+		}
+		if backendUrl.RawQuery != "" || backendUrl.Fragment != "" {
+			return nil, fmt.Errorf("backend %s should not contain query or fragment", backend)
+		}
+		hostAddrs = append(hostAddrs, HostAddr(backendUrl))
+	}
+
+	return hostAddrs, nil
+}
+
+// NewBalancedPool creates the pool of clients for each backend and starts the
+// active health checks if the health check path is configured
+func NewBalancedPool(initialCap, maxCap int, hostAddrs []string, weights []int, server *config.Server, tlsConfig *tls.Config, logger *logrus.Logger) (Pool, error) {
+	if len(hostAddrs) == 0 {
+		return nil, errors.New("no backends configured")
+	}
+
+	if len(weights) > 0 && len(weights) != len(hostAddrs) {
+		return nil, fmt.Errorf("number of backend weights (%d) doesn't match number of backends (%d)", len(weights), len(hostAddrs))
+	}
+
+	serverUrl, err := url.Parse(server.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := &balancedPool{
+		algorithm: server.LoadBalancing,
+		server:    server,
+		scheme:    serverUrl.Scheme,
+		logger:    logger,
+		stop:      make(chan struct{}),
+	}
+
+	for i, hostAddr := range hostAddrs {
+		weight := 1
+		if len(weights) > 0 {
+			weight = weights[i]
+		}
+		if weight <= 0 {
+			return nil, fmt.Errorf("weight of the backend %s should be > 0", hostAddr)
+		}
+
+		backendPool, err := NewChanPool(initialCap, maxCap, hostAddr, server, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+
+		addr := hostAddr
+		var checkClient healthClient = &fasthttp.Client{
+			Dial: func(string) (net.Conn, error) {
+				return fasthttp.DialTimeout(addr, server.DialTimeout)
+			},
+			TLSConfig: tlsConfig,
+		}
+
+		// the backends which speak h2c only are checked over HTTP/2 too
+		if server.HTTP2 {
+			if checkClient, err = newHTTP2Client(hostAddr, server, tlsConfig); err != nil {
+				return nil, err
+			}
+		}
+
+		pool.backends = append(pool.backends, &backend{
+			host:         hostAddr,
+			weight:       weight,
+			pool:         backendPool,
+			healthy:      true,
+			healthClient: checkClient,
+		})
+	}
+
+	if server.HealthCheck.Path != "" {
+		go pool.healthChecks()
+	}
+
+	return pool, nil
+}
+
+// pick returns the backend for the next request according to the load balancing algorithm
+func (p *balancedPool) pick() (*backend, error) {
+	now := time.Now()
+
+	available := make([]*backend, 0, len(p.backends))
+	for _, b := range p.backends {
+		if b.available(now) {
+			available = append(available, b)
+		}
+	}
+
+	if len(available) == 0 {
+		return nil, errNoHealthyBackends
+	}
+
+	switch p.algorithm {
+	case LeastConnections:
+		// start from the next backend to spread requests between backends with equal load
+		offset := int(atomic.AddUint64(&p.next, 1) % uint64(len(available)))
+		selected := available[offset]
+		for i := 1; i < len(available); i++ {
+			b := available[(offset+i)%len(available)]
+			if atomic.LoadInt64(&b.active) < atomic.LoadInt64(&selected.active) {
+				selected = b
+			}
+		}
+		return selected, nil
+	case Weighted:
+		// smooth weighted round-robin
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+
+		var selected *backend
+		total := 0
+		for _, b := range available {
+			b.currentWeight += b.weight
+			total += b.weight
+			if selected == nil || b.currentWeight > selected.currentWeight {
+				selected = b
+			}
+		}
+		selected.currentWeight -= total
+		return selected, nil
+	default:
+		return available[atomic.AddUint64(&p.next, 1)%uint64(len(available))], nil
+	}
+}
+
+// report updates the passive health state of the backend. The backend is
+// ejected for the fail timeout after MaxFails consecutive dial errors
+func (p *balancedPool) report(b *backend, err error) {
+	if err != nil && !isDialError(err) {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if err == nil {
+		b.fails = 0
+		return
+	}
+
+	b.fails += 1
+	if p.server.MaxFails > 0 && b.fails >= p.server.MaxFails {
+		b.fails = 0
+		b.ejectedUntil = time.Now().Add(p.server.FailTimeout)
+		p.logger.Errorf("proxy: backend %s is ejected for %s after %d failed connections: %s", b.host, p.server.FailTimeout, p.server.MaxFails, err)
+	}
+}
+
+func isDialError(err error) bool {
+	if err == fasthttp.ErrDialTimeout {
+		return true
+	}
+
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// healthChecks periodically sends requests to the health check path of each backend
+func (p *balancedPool) healthChecks() {
+	ticker := time.NewTicker(p.server.HealthCheck.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			for _, b := range p.backends {
+				p.healthCheck(b)
+			}
+		}
+	}
+}
+
+func (p *balancedPool) healthCheck(b *backend) {
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.SetRequestURI(fmt.Sprintf("%s://%s%s", p.scheme, b.host, p.server.HealthCheck.Path))
+
+	err := b.healthClient.DoTimeout(req, resp, p.server.HealthCheck.Timeout)
+	healthy := err == nil && resp.StatusCode() >= 200 && resp.StatusCode() < 400
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if healthy != b.healthy {
+		switch healthy {
+		case true:
+			p.logger.Infof("proxy: backend %s is healthy", b.host)
+		case false:
+			if err != nil {
+				p.logger.Errorf("proxy: backend %s is unhealthy: %s", b.host, err)
+			} else {
+				p.logger.Errorf("proxy: backend %s is unhealthy: status code %d", b.host, resp.StatusCode())
+			}
+		}
+	}
+
+	b.healthy = healthy
+
+	// successful health check returns the ejected backend back to the balancing
+	if healthy {
+		b.fails = 0
+		b.ejectedUntil = time.Time{}
+	}
+}
+
+// Get returns the client of the backend selected by the load balancing algorithm
+func (p *balancedPool) Get() (HTTPClient, error) {
+	b, err := p.pick()
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := b.pool.Get()
+	if err != nil {
+		return nil, err
+	}
+
+	return &backendClient{HTTPClient: client, backend: b, pool: p}, nil
+}
+
+// Put returns the client back to the pool of its backend
+func (p *balancedPool) Put(client HTTPClient) error {
+	bc, ok := client.(*backendClient)
+	if !ok {
+		return errors.New("client doesn't belong to the pool. rejecting")
+	}
+
+	return bc.backend.pool.Put(bc.HTTPClient)
+}
+
+// Close stops the health checks and closes the pools of all backends
+func (p *balancedPool) Close() {
+	p.closeOnce.Do(func() {
+		close(p.stop)
+	})
+
+	for _, b := range p.backends {
+		b.pool.Close()
+	}
+}
+
+// Len returns the total number of clients in the pools of all backends
+func (p *balancedPool) Len() int {
+	total := 0
+	for _, b := range p.backends {
+		total += b.pool.Len()
+	}
+	return total
+}
+
+// Backends returns the current state of all backends
+func (p *balancedPool) Backends() []BackendStatus {
+	now := time.Now()
+
+	statuses := make([]BackendStatus, 0, len(p.backends))
+	for _, b := range p.backends {
+		statuses = append(statuses, BackendStatus{
+			Host:           b.host,
+			Healthy:        b.available(now),
+			ActiveRequests: atomic.LoadInt64(&b.active),
+		})
+	}
+
+	return statuses
+}
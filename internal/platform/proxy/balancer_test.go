@@ -0,0 +1,283 @@
+package proxy
+
+import (
+	"net"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+
+	"github.com/wallarm/api-firewall/internal/config"
+)
+
+func TestBackendHosts(t *testing.T) {
+
+	serverUrl, err := url.ParseRequestURI("http://localhost:3000/v1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hosts, err := BackendHosts(serverUrl, []string{"http://backend-1", "http://backend-2:8080/", "http://backend-3:8080/v1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Join(hosts, ",") != "backend-1:80,backend-2:8080,backend-3:8080" {
+		t.Errorf("Incorrect backend hosts: %v", hosts)
+	}
+
+	for _, backend := range []string{"https://backend-1", "http://backend-1/v2", "http://backend-1/v1?debug=1", "backend-1"} {
+		if _, err := BackendHosts(serverUrl, []string{backend}); err == nil {
+			t.Errorf("Invalid backend %s has been accepted", backend)
+		}
+	}
+}
+
+// startBackend starts the HTTP server of the backend and returns its address
+func startBackend(t *testing.T, handler fasthttp.RequestHandler) string {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := fasthttp.Server{Handler: handler}
+	go server.Serve(ln)
+
+	t.Cleanup(func() {
+		ln.Close()
+	})
+
+	return ln.Addr().String()
+}
+
+// backendName returns the handler of the backend which responds with its name
+func backendName(name string) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		ctx.SetBodyString(name)
+	}
+}
+
+// sendToPool sends the request to the backend selected by the pool and
+// returns the name of the backend
+func sendToPool(pool Pool) (string, error) {
+	client, err := pool.Get()
+	if err != nil {
+		return "", err
+	}
+	defer pool.Put(client)
+
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.SetRequestURI("http://backend/")
+
+	if err := client.Do(req, resp); err != nil {
+		return "", err
+	}
+
+	return string(resp.Body()), nil
+}
+
+// backendHealthy returns the health state of the backend reported by the pool
+func backendHealthy(t *testing.T, pool Pool, host string) bool {
+	for _, status := range pool.(BackendsReporter).Backends() {
+		if status.Host == host {
+			return status.Healthy
+		}
+	}
+	t.Fatalf("Backend %s is not found", host)
+	return false
+}
+
+func TestBalancedPool(t *testing.T) {
+
+	logger := logrus.New()
+
+	serverCfg := config.Server{
+		URL:         "http://localhost/",
+		DialTimeout: 200 * time.Millisecond,
+		FailTimeout: time.Minute,
+	}
+
+	newPool := func(t *testing.T, cfg config.Server, hosts []string, weights []int) Pool {
+		pool, err := NewBalancedPool(1, 10, hosts, weights, &cfg, nil, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(pool.Close)
+		return pool
+	}
+
+	countRequests := func(t *testing.T, pool Pool, n int) map[string]int {
+		counts := make(map[string]int)
+		for i := 0; i < n; i++ {
+			name, err := sendToPool(pool)
+			if err != nil {
+				t.Fatal(err)
+			}
+			counts[name]++
+		}
+		return counts
+	}
+
+	hostA := startBackend(t, backendName("a"))
+	hostB := startBackend(t, backendName("b"))
+	hostC := startBackend(t, backendName("c"))
+
+	t.Run("roundRobin", func(t *testing.T) {
+		cfg := serverCfg
+		cfg.LoadBalancing = RoundRobin
+
+		counts := countRequests(t, newPool(t, cfg, []string{hostA, hostB, hostC}, nil), 6)
+		if counts["a"] != 2 || counts["b"] != 2 || counts["c"] != 2 {
+			t.Errorf("Incorrect round-robin distribution: %v", counts)
+		}
+	})
+
+	t.Run("weighted", func(t *testing.T) {
+		cfg := serverCfg
+		cfg.LoadBalancing = Weighted
+
+		counts := countRequests(t, newPool(t, cfg, []string{hostA, hostB}, []int{1, 3}), 8)
+		if counts["a"] != 2 || counts["b"] != 6 {
+			t.Errorf("Incorrect weighted distribution: %v", counts)
+		}
+
+		if _, err := NewBalancedPool(1, 10, []string{hostA, hostB}, []int{1}, &cfg, nil, logger); err == nil {
+			t.Error("Pool with the wrong number of the weights has been created")
+		}
+
+		if _, err := NewBalancedPool(1, 10, []string{hostA, hostB}, []int{1, 0}, &cfg, nil, logger); err == nil {
+			t.Error("Pool with the zero weight has been created")
+		}
+	})
+
+	t.Run("leastConnections", func(t *testing.T) {
+		cfg := serverCfg
+		cfg.LoadBalancing = LeastConnections
+
+		started := make(chan struct{}, 1)
+		release := make(chan struct{})
+		defer close(release)
+
+		hostSlow := startBackend(t, func(ctx *fasthttp.RequestCtx) {
+			started <- struct{}{}
+			<-release
+			ctx.SetBodyString("slow")
+		})
+
+		pool := newPool(t, cfg, []string{hostSlow, hostA}, nil)
+
+		// the requests are sent until one of them is being processed by the slow backend
+		busy := false
+		for i := 0; i < 4 && !busy; i++ {
+			done := make(chan struct{})
+			go func() {
+				sendToPool(pool)
+				close(done)
+			}()
+
+			select {
+			case <-started:
+				busy = true
+			case <-done:
+			}
+		}
+
+		if !busy {
+			t.Fatal("Requests are not sent to the slow backend")
+		}
+
+		counts := countRequests(t, pool, 4)
+		if counts["a"] != 4 {
+			t.Errorf("Requests are sent to the busy backend: %v", counts)
+		}
+	})
+
+	t.Run("ejection", func(t *testing.T) {
+		cfg := serverCfg
+		cfg.LoadBalancing = RoundRobin
+		cfg.MaxFails = 1
+
+		// nothing listens on the address of the closed listener
+		ln, err := net.Listen("tcp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		hostDown := ln.Addr().String()
+		ln.Close()
+
+		pool := newPool(t, cfg, []string{hostDown, hostA}, nil)
+
+		failed := 0
+		for i := 0; i < 2; i++ {
+			if _, err := sendToPool(pool); err != nil {
+				failed++
+			}
+		}
+
+		if failed != 1 {
+			t.Errorf("Incorrect number of the failed requests. Expected: 1 and got %d", failed)
+		}
+
+		if backendHealthy(t, pool, hostDown) {
+			t.Error("Failed backend is not ejected")
+		}
+
+		counts := countRequests(t, pool, 4)
+		if counts["a"] != 4 {
+			t.Errorf("Requests are sent to the ejected backend: %v", counts)
+		}
+	})
+
+	t.Run("healthChecks", func(t *testing.T) {
+		cfg := serverCfg
+		cfg.LoadBalancing = RoundRobin
+		cfg.HealthCheck = config.HealthCheck{
+			Path:     "/health",
+			Interval: 20 * time.Millisecond,
+			Timeout:  time.Second,
+		}
+
+		var healthStatus int32 = fasthttp.StatusServiceUnavailable
+		hostChecked := startBackend(t, func(ctx *fasthttp.RequestCtx) {
+			if string(ctx.Path()) == "/health" {
+				ctx.SetStatusCode(int(atomic.LoadInt32(&healthStatus)))
+				return
+			}
+			ctx.SetBodyString("checked")
+		})
+
+		pool := newPool(t, cfg, []string{hostChecked, hostA}, nil)
+
+		waitHealthy := func(healthy bool) {
+			for i := 0; i < 100 && backendHealthy(t, pool, hostChecked) != healthy; i++ {
+				time.Sleep(20 * time.Millisecond)
+			}
+			if backendHealthy(t, pool, hostChecked) != healthy {
+				t.Fatalf("Incorrect health state of the backend. Expected: %t", healthy)
+			}
+		}
+
+		waitHealthy(false)
+
+		counts := countRequests(t, pool, 4)
+		if counts["a"] != 4 {
+			t.Errorf("Requests are sent to the unhealthy backend: %v", counts)
+		}
+
+		atomic.StoreInt32(&healthStatus, fasthttp.StatusOK)
+		waitHealthy(true)
+
+		counts = countRequests(t, pool, 4)
+		if counts["checked"] != 2 || counts["a"] != 2 {
+			t.Errorf("Requests are not sent to the healthy backend: %v", counts)
+		}
+	})
+}
@@ -6,11 +6,9 @@ package proxy
 
 import (
 	"crypto/tls"
-	"crypto/x509"
 	"errors"
-	"fmt"
-	"io/ioutil"
 	"net"
+	"net/url"
 	"sync"
 
 	"github.com/valyala/fasthttp"
@@ -42,6 +40,21 @@ func factory(hostAddr string, server *config.Server, tlsConfig *tls.Config) (HTT
 	return proxyClient, nil
 }
 
+// HostAddr returns the host of the URL with the port. The default port of the
+// URL scheme is used if the port is not set.
+func HostAddr(u *url.URL) string {
+	host := u.Host
+	if u.Port() == "" {
+		switch u.Scheme {
+		case "https":
+			host += ":443"
+		case "http":
+			host += ":80"
+		}
+	}
+	return host
+}
+
 type Pool interface {
 	// Get returns a new ReverseProxy from the pool.
 	Get() (HTTPClient, error)
@@ -74,39 +87,17 @@ type chanPool struct {
 	host   string
 
 	tlsConfig *tls.Config
+
+	// shared is the HTTP/2 client used by all requests instead of the clients of the channel
+	shared *http2Client
 }
 
 // NewChanPool to new a pool with some params
-func NewChanPool(initialCap, maxCap int, hostAddr string, server *config.Server) (Pool, error) {
+func NewChanPool(initialCap, maxCap int, hostAddr string, server *config.Server, tlsConfig *tls.Config) (Pool, error) {
 	if initialCap < 0 || maxCap <= 0 || initialCap > maxCap {
 		return nil, errInvalidCapacitySetting
 	}
 
-	// Get the SystemCertPool, continue with an empty pool on error
-	rootCAs, err := x509.SystemCertPool()
-	if err != nil {
-		return nil, err
-	}
-
-	if server.RootCA != "" {
-
-		// Read in the cert file
-		certs, err := ioutil.ReadFile(server.RootCA)
-		if err != nil {
-			return nil, fmt.Errorf("failed to append %q to RootCAs: %v", server.RootCA, err)
-		}
-
-		// Append our cert to the system pool
-		if ok := rootCAs.AppendCertsFromPEM(certs); !ok {
-			return nil, errors.New("no certs appended, using system certs only")
-		}
-	}
-
-	tlsConfig := &tls.Config{
-		InsecureSkipVerify: server.InsecureConnection,
-		RootCAs:            rootCAs,
-	}
-
 	// initialize the chanPool
 	pool := &chanPool{
 		mutex:            sync.RWMutex{},
@@ -116,6 +107,16 @@ func NewChanPool(initialCap, maxCap int, hostAddr string, server *config.Server)
 		tlsConfig:        tlsConfig,
 	}
 
+	// the HTTP/2 connections are multiplexed
+	if server.HTTP2 {
+		shared, err := newHTTP2Client(hostAddr, server, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		pool.shared = shared
+		return pool, nil
+	}
+
 	// create initial connections, if something goes wrong,
 	// just close the pool error out.
 	for i := 0; i < initialCap; i++ {
@@ -159,6 +160,10 @@ func (p *chanPool) Get() (HTTPClient, error) {
 		return nil, errClosed
 	}
 
+	if p.shared != nil {
+		return p.shared, nil
+	}
+
 	// wrap our connections with out custom net.Conn implementation (wrapConn
 	// method) that puts the connection back to the pool if it's closed.
 	select {
@@ -182,6 +187,10 @@ func (p *chanPool) Put(proxy HTTPClient) error {
 		return errors.New("proxy is nil. rejecting")
 	}
 
+	if p.shared != nil {
+		return nil
+	}
+
 	p.mutex.RLock()
 	defer p.mutex.RUnlock()
 
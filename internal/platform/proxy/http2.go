@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"golang.org/x/net/http2"
+
+	"github.com/wallarm/api-firewall/internal/config"
+)
+
+// http2Client sends the requests to the upstream over HTTP/2. The HTTPS
+// upstream negotiates HTTP/2 by TLS ALPN and falls back to HTTP/1.1, the HTTP
+// upstream is connected by h2c with prior knowledge. The streams are
+// multiplexed over the connections, so the single client is shared by the
+// requests to the host.
+type http2Client struct {
+	client  *http.Client
+	timeout time.Duration
+}
+
+func newHTTP2Client(hostAddr string, server *config.Server, tlsConfig *tls.Config) (*http2Client, error) {
+	serverUrl, err := url.Parse(server.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := net.Dialer{Timeout: server.DialTimeout}
+
+	// the host of the request is ignored, the connections are made to the host of the pool
+	dial := func(ctx context.Context, network, _ string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, hostAddr)
+
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return nil, fasthttp.ErrDialTimeout
+		}
+
+		return conn, err
+	}
+
+	var transport http.RoundTripper
+
+	switch serverUrl.Scheme {
+	case "http":
+		transport = &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dial(context.Background(), network, addr)
+			},
+		}
+	default:
+		t := &http.Transport{
+			DialContext: dial,
+			// the shared configuration is modified by the transport
+			TLSClientConfig: tlsConfig.Clone(),
+			MaxConnsPerHost: server.MaxConnsPerHost,
+		}
+		if err := http2.ConfigureTransport(t); err != nil {
+			return nil, err
+		}
+		transport = t
+	}
+
+	return &http2Client{
+		client:  &http.Client{Transport: transport},
+		timeout: server.WriteTimeout + server.ReadTimeout,
+	}, nil
+}
+
+// Do sends the request within the write and the read timeouts of the upstream
+func (c *http2Client) Do(req *fasthttp.Request, resp *fasthttp.Response) error {
+	return c.DoTimeout(req, resp, c.timeout)
+}
+
+// DoTimeout sends the fasthttp request and reads the whole response to the
+// fasthttp response
+func (c *http2Client) DoTimeout(req *fasthttp.Request, resp *fasthttp.Response, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	httpReq, err := http.NewRequestWithContext(ctx, string(req.Header.Method()), req.URI().String(), bytes.NewReader(req.Body()))
+	if err != nil {
+		return err
+	}
+
+	httpReq.Host = string(req.Header.Host())
+
+	req.Header.VisitAll(func(key, value []byte) {
+		switch string(key) {
+		case fasthttp.HeaderHost, fasthttp.HeaderConnection, fasthttp.HeaderContentLength, fasthttp.HeaderTransferEncoding:
+			return
+		}
+		httpReq.Header.Add(string(key), string(value))
+	})
+
+	httpResp, err := c.client.Do(httpReq)
+	if err != nil {
+		if errors.Is(err, fasthttp.ErrDialTimeout) {
+			return fasthttp.ErrDialTimeout
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			return fasthttp.ErrTimeout
+		}
+		return err
+	}
+	defer httpResp.Body.Close()
+
+	body, err := ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return fasthttp.ErrTimeout
+		}
+		return err
+	}
+
+	resp.Reset()
+	resp.SetStatusCode(httpResp.StatusCode)
+
+	for key, values := range httpResp.Header {
+		if key == fasthttp.HeaderContentLength {
+			continue
+		}
+		for _, value := range values {
+			resp.Header.Add(key, value)
+		}
+	}
+
+	resp.SetBody(body)
+
+	// the body of the response to HEAD request is skipped, the length is kept
+	if req.Header.IsHead() {
+		resp.SkipBody = true
+		if httpResp.ContentLength >= 0 {
+			resp.Header.SetContentLength(int(httpResp.ContentLength))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,211 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/wallarm/api-firewall/internal/config"
+	"github.com/wallarm/api-firewall/internal/platform/watcher"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// UpstreamTLS is the TLS configuration of the upstream connections shared by
+// the clients of the pool. The client certificate is reloaded on change of
+// the certificate or the key file.
+type UpstreamTLS struct {
+	Config *tls.Config
+
+	logger *logrus.Logger
+
+	mutex      sync.RWMutex
+	clientCert *tls.Certificate
+	sessions   *sessionCache
+
+	certWatcher *watcher.Watcher
+}
+
+// NewUpstreamTLS returns the TLS configuration of the upstream connections
+func NewUpstreamTLS(server *config.Server, logger *logrus.Logger) (*UpstreamTLS, error) {
+
+	// Get the SystemCertPool, continue with an empty pool on error
+	rootCAs, err := x509.SystemCertPool()
+	if err != nil {
+		return nil, err
+	}
+
+	if server.RootCA != "" {
+
+		// Read in the cert file
+		certs, err := ioutil.ReadFile(server.RootCA)
+		if err != nil {
+			return nil, fmt.Errorf("failed to append %q to RootCAs: %v", server.RootCA, err)
+		}
+
+		// Append our cert to the system pool
+		if ok := rootCAs.AppendCertsFromPEM(certs); !ok {
+			return nil, errors.New("no certs appended, using system certs only")
+		}
+	}
+
+	upstreamTLS := UpstreamTLS{
+		Config: &tls.Config{
+			InsecureSkipVerify: server.InsecureConnection,
+			RootCAs:            rootCAs,
+			ServerName:         server.ServerName,
+		},
+		logger: logger,
+	}
+
+	if server.MinTLSVersion != "" {
+		version, ok := tlsVersions[server.MinTLSVersion]
+		if !ok {
+			return nil, fmt.Errorf("unsupported TLS version %q", server.MinTLSVersion)
+		}
+		upstreamTLS.Config.MinVersion = version
+	}
+
+	if len(server.CipherSuites) > 0 {
+		if upstreamTLS.Config.CipherSuites, err = cipherSuites(server.CipherSuites); err != nil {
+			return nil, err
+		}
+	}
+
+	if server.ClientCert == "" && server.ClientKey == "" {
+		return &upstreamTLS, nil
+	}
+
+	if server.ClientCert == "" || server.ClientKey == "" {
+		return nil, errors.New("both client certificate and key should be set")
+	}
+
+	// the certificate and the key are watched as the single resource
+	readClientCert := func() ([]byte, error) {
+		cert, err := ioutil.ReadFile(server.ClientCert)
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := ioutil.ReadFile(server.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+
+		return append(append(cert, '\n'), key...), nil
+	}
+
+	data, err := readClientCert()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client certificate: %v", err)
+	}
+
+	if err := upstreamTLS.loadClientCert(data); err != nil {
+		return nil, err
+	}
+
+	upstreamTLS.sessions = &sessionCache{cache: tls.NewLRUClientSessionCache(0)}
+
+	upstreamTLS.Config.GetClientCertificate = upstreamTLS.getClientCertificate
+	upstreamTLS.Config.ClientSessionCache = upstreamTLS.sessions
+
+	if server.CertUpdateInterval > 0 {
+		upstreamTLS.certWatcher = watcher.New(server.ClientCert, server.CertUpdateInterval, readClientCert, upstreamTLS.loadClientCert, logger)
+		upstreamTLS.certWatcher.Start(data)
+	}
+
+	return &upstreamTLS, nil
+}
+
+// loadClientCert replaces the client certificate. The data contains the PEM
+// blocks of both the certificate and the key.
+func (u *UpstreamTLS) loadClientCert(data []byte) error {
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return fmt.Errorf("failed to load client certificate: %v", err)
+	}
+
+	u.mutex.Lock()
+	u.clientCert = &cert
+	u.mutex.Unlock()
+
+	// resumed sessions keep the previous certificate
+	if u.sessions != nil {
+		u.sessions.reset()
+	}
+
+	u.logger.Infof("proxy: upstream client certificate loaded")
+
+	return nil
+}
+
+func (u *UpstreamTLS) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+
+	return u.clientCert, nil
+}
+
+// Close stops watching the client certificate
+func (u *UpstreamTLS) Close() {
+	if u.certWatcher != nil {
+		u.certWatcher.Stop()
+	}
+}
+
+// sessionCache is the TLS session cache of the upstream connections. The
+// sessions are dropped on the client certificate reload, so the next
+// handshake presents the new certificate.
+type sessionCache struct {
+	mutex sync.RWMutex
+	cache tls.ClientSessionCache
+}
+
+func (c *sessionCache) Get(sessionKey string) (*tls.ClientSessionState, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.cache.Get(sessionKey)
+}
+
+func (c *sessionCache) Put(sessionKey string, cs *tls.ClientSessionState) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	c.cache.Put(sessionKey, cs)
+}
+
+func (c *sessionCache) reset() {
+	c.mutex.Lock()
+	c.cache = tls.NewLRUClientSessionCache(0)
+	c.mutex.Unlock()
+}
+
+// cipherSuites returns the IDs of the cipher suites by the names
+func cipherSuites(names []string) ([]uint16, error) {
+	supported := make(map[string]uint16)
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		supported[suite.Name] = suite.ID
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := supported[name]
+		if !ok {
+			return nil, fmt.Errorf("unsupported cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
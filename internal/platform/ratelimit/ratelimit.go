@@ -0,0 +1,120 @@
+package ratelimit
+
+import (
+	"container/list"
+	"math"
+	"sync"
+	"time"
+)
+
+// buckets which have not been used for this number of periods are removed
+// if they are refilled completely
+const idlePeriods = 10
+
+// DefaultMaxKeys is the number of the buckets kept by the limiter if the
+// limit is not set
+const DefaultMaxKeys = 100000
+
+type bucket struct {
+	key      string
+	tokens   float64
+	lastSeen time.Time
+}
+
+// Limiter is the token bucket rate limiter. Each key has its own bucket
+// which holds up to burst tokens and is refilled with rate tokens per period.
+// The buckets are kept in the order of use, so the idle buckets are removed
+// from the tail without scanning all buckets and the least recently used
+// bucket is evicted when the number of the keys reaches the limit.
+type Limiter struct {
+	rate    float64
+	period  time.Duration
+	burst   float64
+	maxKeys int
+
+	mutex   sync.Mutex
+	buckets map[string]*list.Element
+	lru     *list.List
+}
+
+// New creates the rate limiter which allows rate requests per period with the
+// bursts up to burst requests. The burst is equal to the rate if it is not set.
+// The limiter keeps up to maxKeys buckets, DefaultMaxKeys if it is not set.
+func New(rate int, period time.Duration, burst int, maxKeys int) *Limiter {
+	if burst <= 0 {
+		burst = rate
+	}
+
+	if maxKeys <= 0 {
+		maxKeys = DefaultMaxKeys
+	}
+
+	return &Limiter{
+		rate:    float64(rate),
+		period:  period,
+		burst:   float64(burst),
+		maxKeys: maxKeys,
+		buckets: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// Allow takes the token from the bucket of the key. If the bucket is empty
+// it returns false and the time after which the next token is available.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	now := time.Now()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.sweep(now)
+
+	var b *bucket
+
+	if e, ok := l.buckets[key]; ok {
+		b = e.Value.(*bucket)
+		l.lru.MoveToFront(e)
+	} else {
+		if l.lru.Len() >= l.maxKeys {
+			l.remove(l.lru.Back())
+		}
+		b = &bucket{key: key, tokens: l.burst, lastSeen: now}
+		l.buckets[key] = l.lru.PushFront(b)
+	}
+
+	// refill the bucket with the tokens accumulated since the last request
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.lastSeen).Seconds()*l.rate/l.period.Seconds())
+	b.lastSeen = now
+
+	if b.tokens >= 1 {
+		b.tokens -= 1
+		return true, 0
+	}
+
+	wait := time.Duration((1 - b.tokens) * float64(l.period) / l.rate)
+	return false, wait
+}
+
+// Len returns the number of the buckets
+func (l *Limiter) Len() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.lru.Len()
+}
+
+// sweep removes the idle buckets to limit the memory used by the unique keys.
+// The least recently used buckets are at the tail, so only the removed
+// buckets are visited.
+func (l *Limiter) sweep(now time.Time) {
+	idle := time.Duration(math.Max(idlePeriods, l.burst/l.rate) * float64(l.period))
+
+	for e := l.lru.Back(); e != nil && now.Sub(e.Value.(*bucket).lastSeen) >= idle; e = l.lru.Back() {
+		l.remove(e)
+	}
+}
+
+func (l *Limiter) remove(e *list.Element) {
+	l.lru.Remove(e)
+	delete(l.buckets, e.Value.(*bucket).key)
+}
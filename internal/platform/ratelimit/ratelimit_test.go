@@ -0,0 +1,109 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiterRefill(t *testing.T) {
+
+	limiter := New(10, 100*time.Millisecond, 2, 0)
+
+	// the bucket holds up to the burst tokens
+	for i := 0; i < 2; i++ {
+		if allowed, _ := limiter.Allow("key"); !allowed {
+			t.Fatalf("Request %d of the burst is not allowed", i+1)
+		}
+	}
+
+	allowed, wait := limiter.Allow("key")
+	if allowed {
+		t.Fatal("Request over the burst is allowed")
+	}
+	if wait <= 0 || wait > 10*time.Millisecond {
+		t.Errorf("Incorrect wait time of the next token. Expected: up to 10ms and got %s", wait)
+	}
+
+	// the buckets of the other keys are not shared
+	if allowed, _ := limiter.Allow("other"); !allowed {
+		t.Error("Request of the other key is not allowed")
+	}
+
+	// the bucket is refilled with the rate tokens per period
+	time.Sleep(wait + 5*time.Millisecond)
+
+	if allowed, _ := limiter.Allow("key"); !allowed {
+		t.Error("Request is not allowed after the bucket refill")
+	}
+
+	// the bucket is refilled up to the burst only
+	time.Sleep(100 * time.Millisecond)
+
+	for i := 0; i < 2; i++ {
+		if allowed, _ := limiter.Allow("key"); !allowed {
+			t.Fatalf("Request %d of the refilled burst is not allowed", i+1)
+		}
+	}
+
+	if allowed, _ := limiter.Allow("key"); allowed {
+		t.Error("Request over the refilled burst is allowed")
+	}
+}
+
+func TestLimiterEviction(t *testing.T) {
+
+	// the least recently used bucket is evicted when the number of the keys reaches the limit
+	limiter := New(1, time.Minute, 1, 2)
+	for _, key := range []string{"a", "b", "a", "c"} {
+		limiter.Allow(key)
+	}
+
+	if n := limiter.Len(); n != 2 {
+		t.Errorf("Incorrect number of the buckets. Expected: 2 and got %d", n)
+	}
+
+	if allowed, _ := limiter.Allow("a"); allowed {
+		t.Error("Request of the recently used key is allowed over the limit")
+	}
+
+	if allowed, _ := limiter.Allow("b"); !allowed {
+		t.Error("Request of the evicted key is not allowed")
+	}
+}
+
+func TestLimiterSweep(t *testing.T) {
+
+	limiter := New(1, time.Millisecond, 1, 0)
+	for _, key := range []string{"a", "b", "c"} {
+		limiter.Allow(key)
+	}
+
+	// the buckets idle for the idle periods are removed on the next request
+	time.Sleep(idlePeriods*time.Millisecond + 5*time.Millisecond)
+
+	limiter.Allow("d")
+
+	if n := limiter.Len(); n != 1 {
+		t.Errorf("Incorrect number of the buckets after the sweep. Expected: 1 and got %d", n)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+
+	registry := NewRegistry()
+
+	limiter := registry.Limiter("getUsers", 1, time.Minute, 0, 0)
+
+	// the default burst and the default number of the keys are the same limits
+	if registry.Limiter("getUsers", 1, time.Minute, 1, DefaultMaxKeys) != limiter {
+		t.Error("Limiter of the same limits is created again")
+	}
+
+	if registry.Limiter("getOrders", 1, time.Minute, 0, 0) == limiter {
+		t.Error("Limiter is shared by the different names")
+	}
+
+	if registry.Limiter("getUsers", 2, time.Minute, 0, 0) == limiter {
+		t.Error("Limiter is not created again after the limits change")
+	}
+}
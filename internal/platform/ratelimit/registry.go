@@ -0,0 +1,42 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Registry keeps the limiters by the name. The limiters are shared by the
+// handlers built from the versions of the API spec, so the buckets are not
+// reset when the spec is reloaded.
+type Registry struct {
+	mutex    sync.Mutex
+	limiters map[string]*Limiter
+}
+
+func NewRegistry() *Registry {
+	return &Registry{limiters: make(map[string]*Limiter)}
+}
+
+// Limiter returns the limiter of the name. The new limiter is created if
+// there is no limiter of the name or the limits of the limiter are changed.
+func (r *Registry) Limiter(name string, rate int, period time.Duration, burst int, maxKeys int) *Limiter {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if burst <= 0 {
+		burst = rate
+	}
+
+	if maxKeys <= 0 {
+		maxKeys = DefaultMaxKeys
+	}
+
+	if l, ok := r.limiters[name]; ok && l.rate == float64(rate) && l.period == period && l.burst == float64(burst) && l.maxKeys == maxKeys {
+		return l
+	}
+
+	l := New(rate, period, burst, maxKeys)
+	r.limiters[name] = l
+
+	return l
+}
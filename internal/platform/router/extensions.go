@@ -0,0 +1,63 @@
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/wallarm/api-firewall/internal/platform/openapi3"
+	"github.com/wallarm/api-firewall/internal/platform/routers"
+)
+
+// Vendor extensions of the API spec which override the configuration
+const (
+	ExtRequestValidation  = "x-apifw-request-validation"
+	ExtResponseValidation = "x-apifw-response-validation"
+	ExtRateLimit          = "x-apifw-rate-limit"
+	ExtRequiredClaims     = "x-apifw-required-claims"
+	ExtOwner              = "x-apifw-owner"
+	ExtAuthz              = "x-apifw-authz"
+	ExtClientCerts        = "x-apifw-client-certs"
+	ExtIPAllow            = "x-apifw-ip-allow"
+	ExtIPDeny             = "x-apifw-ip-deny"
+	ExtGeoIP              = "x-apifw-geoip"
+)
+
+// Extension decodes the value of the vendor extension of the route into v.
+// The extension of the operation overrides the extension of the path item and
+// the extension of the path item overrides the extension of the spec root.
+// It returns false if the extension is not set at any level.
+func Extension(route *routers.Route, name string, v interface{}) (bool, error) {
+	var levels []openapi3.ExtensionProps
+
+	if route.Operation != nil {
+		levels = append(levels, route.Operation.ExtensionProps)
+	}
+	if route.PathItem != nil {
+		levels = append(levels, route.PathItem.ExtensionProps)
+	}
+	if route.Swagger != nil {
+		levels = append(levels, route.Swagger.ExtensionProps)
+	}
+
+	for _, props := range levels {
+		value, ok := props.Extensions[name]
+		if !ok {
+			continue
+		}
+
+		raw, ok := value.(json.RawMessage)
+		if !ok {
+			var err error
+			if raw, err = json.Marshal(value); err != nil {
+				return false, fmt.Errorf("%s: %w", name, err)
+			}
+		}
+
+		if err := json.Unmarshal(raw, v); err != nil {
+			return false, fmt.Errorf("%s: %w", name, err)
+		}
+		return true, nil
+	}
+
+	return false, nil
+}
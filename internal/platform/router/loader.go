@@ -0,0 +1,50 @@
+package router
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/wallarm/api-firewall/internal/platform/openapi3"
+)
+
+const specDownloadTimeout = 30 * time.Second
+
+// SpecLocation converts the value of the APISpecs parameter to the location
+// of the spec. The value is treated as a file path if it is not a valid URL.
+func SpecLocation(apiSpecs string) *url.URL {
+	location, err := url.ParseRequestURI(apiSpecs)
+	if err != nil || location.Scheme == "" || location.Host == "" {
+		return &url.URL{Path: apiSpecs}
+	}
+	return location
+}
+
+// ReadSpec returns the raw content of the spec stored in the file or
+// available by the URL.
+func ReadSpec(location *url.URL) ([]byte, error) {
+	if location.Scheme == "" && location.Host == "" {
+		return ioutil.ReadFile(location.Path)
+	}
+
+	client := http.Client{Timeout: specDownloadTimeout}
+
+	resp, err := client.Get(location.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d while downloading %s", resp.StatusCode, location.String())
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+// LoadSwagger parses the raw spec and resolves its references relative to the location.
+func LoadSwagger(data []byte, location *url.URL) (*openapi3.Swagger, error) {
+	return openapi3.NewSwaggerLoader().LoadSwaggerFromDataWithPath(data, location)
+}
@@ -17,7 +17,8 @@ import (
 
 // Router helps link http.Request.s and an OpenAPIv3 spec
 type Router struct {
-	Routes []Route
+	Routes  []Route
+	Swagger *openapi3.Swagger
 }
 
 type Route struct {
@@ -34,7 +35,7 @@ func NewRouter(doc *openapi3.Swagger) (*Router, error) {
 	if err := doc.Validate(context.Background()); err != nil {
 		return nil, fmt.Errorf("validating OpenAPI failed: %v", err)
 	}
-	var router Router
+	router := Router{Swagger: doc}
 
 	for path, pathItem := range doc.Paths {
 		for method, operation := range pathItem.Operations() {
@@ -0,0 +1,148 @@
+package tests
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// MMDBNetwork is the IPv4 network of the test MaxMind database
+type MMDBNetwork struct {
+	CIDR   string
+	Record map[string]interface{}
+}
+
+// WriteMMDB writes the IPv4 MaxMind database of the networks with the
+// 24-bit records. The networks should not overlap.
+func WriteMMDB(t *testing.T, file, databaseType string, networks []MMDBNetwork) {
+	t.Helper()
+
+	const (
+		recordEmpty = -1
+		recordData  = -2
+	)
+
+	type record struct {
+		value int
+		data  int
+	}
+
+	nodes := [][2]record{{{value: recordEmpty}, {value: recordEmpty}}}
+	var data bytes.Buffer
+
+	for _, network := range networks {
+		_, ipNet, err := net.ParseCIDR(network.CIDR)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		offset := data.Len()
+		mmdbEncode(&data, network.Record)
+
+		ip := ipNet.IP.To4()
+		prefixLen, _ := ipNet.Mask.Size()
+
+		node := 0
+		for i := 0; i < prefixLen; i++ {
+			bit := (ip[i/8] >> (7 - uint(i%8))) & 1
+			if i == prefixLen-1 {
+				nodes[node][bit] = record{value: recordData, data: offset}
+				break
+			}
+			if nodes[node][bit].value == recordEmpty {
+				nodes = append(nodes, [2]record{{value: recordEmpty}, {value: recordEmpty}})
+				nodes[node][bit] = record{value: len(nodes) - 1}
+			}
+			node = nodes[node][bit].value
+		}
+	}
+
+	var db bytes.Buffer
+	nodeCount := len(nodes)
+
+	for _, node := range nodes {
+		for _, r := range node {
+			value := r.value
+			switch value {
+			case recordEmpty:
+				value = nodeCount
+			case recordData:
+				value = nodeCount + 16 + r.data
+			}
+			db.Write([]byte{byte(value >> 16), byte(value >> 8), byte(value)})
+		}
+	}
+
+	db.Write(make([]byte, 16))
+	db.Write(data.Bytes())
+
+	db.WriteString("\xAB\xCD\xEFMaxMind.com")
+	mmdbEncode(&db, map[string]interface{}{
+		"node_count":                  uint(nodeCount),
+		"record_size":                 uint(24),
+		"ip_version":                  uint(4),
+		"database_type":               databaseType,
+		"languages":                   []string{"en"},
+		"binary_format_major_version": uint(2),
+		"binary_format_minor_version": uint(0),
+		"build_epoch":                 uint(time.Now().Unix()),
+		"description":                 map[string]interface{}{"en": "Test database"},
+	})
+
+	if err := os.WriteFile(file, db.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// mmdbEncode writes the value in the MaxMind DB data section format
+func mmdbEncode(buf *bytes.Buffer, v interface{}) {
+
+	// the sizes up to 284 and the extended types are supported
+	control := func(kind, size int) {
+		head, extra := size, -1
+		if size >= 29 {
+			head, extra = 29, size-29
+		}
+
+		if kind <= 7 {
+			buf.WriteByte(byte(kind<<5 | head))
+		} else {
+			buf.WriteByte(byte(head))
+			buf.WriteByte(byte(kind - 7))
+		}
+
+		if extra >= 0 {
+			buf.WriteByte(byte(extra))
+		}
+	}
+
+	switch v := v.(type) {
+	case string:
+		control(2, len(v))
+		buf.WriteString(v)
+	case uint:
+		var b []byte
+		for n := uint64(v); n > 0; n >>= 8 {
+			b = append([]byte{byte(n)}, b...)
+		}
+		if len(b) <= 4 {
+			control(6, len(b))
+		} else {
+			control(9, len(b))
+		}
+		buf.Write(b)
+	case []string:
+		control(11, len(v))
+		for _, s := range v {
+			mmdbEncode(buf, s)
+		}
+	case map[string]interface{}:
+		control(7, len(v))
+		for key, value := range v {
+			mmdbEncode(buf, key)
+			mmdbEncode(buf, value)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package watcher
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// LoadFunc returns the current content of the watched resource.
+type LoadFunc func() ([]byte, error)
+
+// UpdateFunc applies the new content of the watched resource.
+type UpdateFunc func(data []byte) error
+
+// Watcher polls a resource (local file or remote URL) with the configured
+// interval and calls the update function every time the content of the
+// resource changes.
+type Watcher struct {
+	name     string
+	interval time.Duration
+	load     LoadFunc
+	update   UpdateFunc
+	logger   *logrus.Logger
+
+	digest   [sha256.Size]byte
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// New creates a watcher for the resource. The name is used in the log messages only.
+func New(name string, interval time.Duration, load LoadFunc, update UpdateFunc, logger *logrus.Logger) *Watcher {
+	return &Watcher{
+		name:     name,
+		interval: interval,
+		load:     load,
+		update:   update,
+		logger:   logger,
+		stop:     make(chan struct{}),
+	}
+}
+
+// Start runs the polling loop in the background. The initial content is the
+// content of the resource that is already in use by the caller.
+func (w *Watcher) Start(initial []byte) {
+	w.digest = sha256.Sum256(initial)
+
+	go func() {
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-w.stop:
+				return
+			case <-ticker.C:
+				w.check()
+			}
+		}
+	}()
+}
+
+// Stop stops the polling loop.
+func (w *Watcher) Stop() {
+	w.stopOnce.Do(func() {
+		close(w.stop)
+	})
+}
+
+func (w *Watcher) check() {
+	data, err := w.load()
+	if err != nil {
+		w.logger.Errorf("watcher: %s: can't read the resource: %s", w.name, err)
+		return
+	}
+
+	digest := sha256.Sum256(data)
+	if digest == w.digest {
+		return
+	}
+
+	// the digest is updated even if the new content has not been applied to
+	// avoid reporting the same broken content on every tick
+	w.digest = digest
+
+	w.logger.Infof("watcher: %s: change detected", w.name)
+
+	if err := w.update(data); err != nil {
+		w.logger.Errorf("watcher: %s: the new version has not been applied: %s", w.name, err)
+		return
+	}
+
+	w.logger.Infof("watcher: %s: the new version has been applied", w.name)
+}
@@ -0,0 +1,117 @@
+package watcher
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// testResource is the watched resource which records the applied versions
+type testResource struct {
+	mutex   sync.Mutex
+	data    string
+	loadErr error
+	updates []string
+}
+
+func (r *testResource) set(data string, loadErr error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.data, r.loadErr = data, loadErr
+}
+
+func (r *testResource) load() ([]byte, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return []byte(r.data), r.loadErr
+}
+
+func (r *testResource) update(data []byte) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.updates = append(r.updates, string(data))
+	if string(data) == "broken" {
+		return errors.New("broken version")
+	}
+	return nil
+}
+
+func (r *testResource) applied() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return append([]string(nil), r.updates...)
+}
+
+// waitUpdates waits until the number of the update calls reaches n
+func (r *testResource) waitUpdates(t *testing.T, n int) []string {
+	t.Helper()
+
+	for i := 0; i < 100 && len(r.applied()) < n; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	updates := r.applied()
+	if len(updates) < n {
+		t.Fatalf("Incorrect number of the updates. Expected: %d and got %v", n, updates)
+	}
+	return updates
+}
+
+func TestWatcher(t *testing.T) {
+
+	resource := testResource{data: "v1"}
+
+	w := New("test", 10*time.Millisecond, resource.load, resource.update, logrus.New())
+	w.Start([]byte("v1"))
+	defer w.Stop()
+
+	// the initial content is not applied again
+	time.Sleep(50 * time.Millisecond)
+	if updates := resource.applied(); len(updates) != 0 {
+		t.Fatalf("Unchanged resource is applied: %v", updates)
+	}
+
+	resource.set("v2", nil)
+	if updates := resource.waitUpdates(t, 1); updates[0] != "v2" {
+		t.Errorf("Incorrect applied version. Expected: v2 and got %s", updates[0])
+	}
+
+	// the broken version is applied once, the resource read errors are skipped
+	resource.set("broken", nil)
+	resource.waitUpdates(t, 2)
+
+	resource.set("v3", errors.New("resource is not available"))
+	time.Sleep(50 * time.Millisecond)
+
+	resource.set("v3", nil)
+	if updates := resource.waitUpdates(t, 3); updates[1] != "broken" || updates[2] != "v3" || len(updates) != 3 {
+		t.Errorf("Incorrect applied versions. Expected: [v2 broken v3] and got %v", updates)
+	}
+}
+
+func TestWatcherStop(t *testing.T) {
+
+	resource := testResource{data: "v1"}
+
+	w := New("test", 10*time.Millisecond, resource.load, resource.update, logrus.New())
+	w.Start([]byte("v1"))
+
+	w.Stop()
+	w.Stop()
+
+	// the changes are not applied after Stop
+	time.Sleep(20 * time.Millisecond)
+	resource.set("v2", nil)
+	time.Sleep(50 * time.Millisecond)
+
+	if updates := resource.applied(); len(updates) != 0 {
+		t.Errorf("Resource is applied after Stop: %v", updates)
+	}
+}
@@ -0,0 +1,117 @@
+package web
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+
+	"github.com/wallarm/api-firewall/internal/config"
+)
+
+// Headers with the fields of the client certificate forwarded to the upstream
+const (
+	ClientCertSubjectHeader     = "APIFW-Client-Cert-Subject"
+	ClientCertSANHeader         = "APIFW-Client-Cert-SAN"
+	ClientCertFingerprintHeader = "APIFW-Client-Cert-Fingerprint"
+)
+
+// Client certificate verification modes of the listener
+const (
+	ClientAuthNone    = "NONE"
+	ClientAuthRequest = "REQUEST"
+	ClientAuthRequire = "REQUIRE"
+)
+
+// NewServerTLSConfig returns the TLS configuration of the listener with the
+// client certificate verification. The certificate of the server is appended
+// by the server.
+func NewServerTLSConfig(cfg *config.TLS) (*tls.Config, error) {
+	tlsConfig := tls.Config{ClientAuth: tls.NoClientCert}
+
+	switch strings.ToUpper(cfg.ClientAuth) {
+	case "", ClientAuthNone:
+		return &tlsConfig, nil
+	case ClientAuthRequest:
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	case ClientAuthRequire:
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("unsupported client auth mode %q", cfg.ClientAuth)
+	}
+
+	if cfg.ClientCA == "" {
+		return nil, fmt.Errorf("client CA is required by client auth mode %s", cfg.ClientAuth)
+	}
+
+	certs, err := ioutil.ReadFile(path.Join(cfg.CertsPath, cfg.ClientCA))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client CA: %v", err)
+	}
+
+	tlsConfig.ClientCAs = x509.NewCertPool()
+	if ok := tlsConfig.ClientCAs.AppendCertsFromPEM(certs); !ok {
+		return nil, fmt.Errorf("no client CA certs appended from %q", cfg.ClientCA)
+	}
+
+	return &tlsConfig, nil
+}
+
+// ClientCertificate returns the verified certificate of the client. It
+// returns nil if the client didn't send the certificate.
+func ClientCertificate(ctx *fasthttp.RequestCtx) *x509.Certificate {
+	state := ctx.TLSConnectionState()
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+
+	return state.PeerCertificates[0]
+}
+
+// CertificateFingerprint returns the hex encoded SHA-256 of the certificate
+func CertificateFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// CertificateSANs returns the DNS names, emails, IP addresses and URIs of the
+// subject alternative names of the certificate
+func CertificateSANs(cert *x509.Certificate) []string {
+	sans := make([]string, 0, len(cert.DNSNames)+len(cert.EmailAddresses)+len(cert.IPAddresses)+len(cert.URIs))
+
+	sans = append(sans, cert.DNSNames...)
+	sans = append(sans, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+
+	return sans
+}
+
+// SetClientCertHeaders replaces the client-supplied certificate headers by
+// the fields of the verified client certificate
+func SetClientCertHeaders(ctx *fasthttp.RequestCtx) {
+	ctx.Request.Header.Del(ClientCertSubjectHeader)
+	ctx.Request.Header.Del(ClientCertSANHeader)
+	ctx.Request.Header.Del(ClientCertFingerprintHeader)
+
+	cert := ClientCertificate(ctx)
+	if cert == nil {
+		return
+	}
+
+	ctx.Request.Header.Set(ClientCertSubjectHeader, cert.Subject.String())
+	if sans := CertificateSANs(cert); len(sans) > 0 {
+		ctx.Request.Header.Set(ClientCertSANHeader, strings.Join(sans, ","))
+	}
+	ctx.Request.Header.Set(ClientCertFingerprintHeader, CertificateFingerprint(cert))
+}
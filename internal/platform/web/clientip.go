@@ -0,0 +1,97 @@
+package web
+
+import (
+	"net"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+func isTrusted(ip net.IP, trustedProxies []*net.IPNet) bool {
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Headers with the addresses of the proxied clients
+const (
+	XForwardedForHeader = "X-Forwarded-For"
+	ForwardedHeader     = "Forwarded"
+)
+
+// ClientIP returns the IP address of the client. The X-Forwarded-For or the
+// Forwarded header is used only if the request comes from the trusted proxy.
+// The addresses of the header are checked from right to left and the first
+// address which doesn't belong to the trusted proxies is the client address.
+// If the address added by the trusted proxy is malformed or obfuscated (e.g.
+// for=unknown) the client can't be identified and nil is returned.
+func ClientIP(ctx *fasthttp.RequestCtx, trustedProxies []*net.IPNet, header string) net.IP {
+	clientIP := ctx.RemoteIP()
+
+	if len(trustedProxies) == 0 || !isTrusted(clientIP, trustedProxies) {
+		return clientIP
+	}
+
+	var addrs []string
+
+	switch header {
+	case ForwardedHeader:
+		addrs = forwardedFor(string(ctx.Request.Header.Peek(ForwardedHeader)))
+	default:
+		if xff := ctx.Request.Header.Peek(XForwardedForHeader); len(xff) > 0 {
+			addrs = strings.Split(string(xff), ",")
+		}
+	}
+
+	for i := len(addrs) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(addrs[i]))
+		if ip == nil {
+			// the address added by the trusted proxy is unknown
+			return nil
+		}
+
+		clientIP = ip
+		if !isTrusted(ip, trustedProxies) {
+			break
+		}
+	}
+
+	return clientIP
+}
+
+// forwardedFor returns the addresses of the for parameters of the Forwarded
+// header (RFC 7239) without the ports. The obfuscated identifiers are
+// returned as is.
+func forwardedFor(header string) []string {
+	if header == "" {
+		return nil
+	}
+
+	var addrs []string
+
+	for _, element := range strings.Split(header, ",") {
+		for _, pair := range strings.Split(element, ";") {
+			i := strings.IndexByte(pair, '=')
+			if i < 0 || !strings.EqualFold(strings.TrimSpace(pair[:i]), "for") {
+				continue
+			}
+
+			addr := strings.Trim(strings.TrimSpace(pair[i+1:]), `"`)
+			switch {
+			case strings.HasPrefix(addr, "["):
+				if end := strings.IndexByte(addr, ']'); end > 0 {
+					addr = addr[1:end]
+				}
+			case strings.Count(addr, ":") == 1:
+				addr = addr[:strings.IndexByte(addr, ':')]
+			}
+
+			addrs = append(addrs, addr)
+		}
+	}
+
+	return addrs
+}
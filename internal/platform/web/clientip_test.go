@@ -0,0 +1,75 @@
+package web
+
+import (
+	"net"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestClientIP(t *testing.T) {
+
+	var trustedProxies []*net.IPNet
+	for _, cidr := range []string{"192.0.2.1/32", "10.0.0.0/8"} {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		trustedProxies = append(trustedProxies, network)
+	}
+
+	tests := []struct {
+		name     string
+		remoteIP string
+		header   string
+		value    string
+		clientIP string
+	}{
+		{name: "remote address", remoteIP: "203.0.113.7", clientIP: "203.0.113.7"},
+		{name: "header of the untrusted proxy", remoteIP: "198.51.100.1", header: XForwardedForHeader, value: "10.1.1.1", clientIP: "198.51.100.1"},
+		{name: "client of the trusted proxy", remoteIP: "192.0.2.1", header: XForwardedForHeader, value: "203.0.113.7", clientIP: "203.0.113.7"},
+		{name: "chain of the trusted proxies", remoteIP: "192.0.2.1", header: XForwardedForHeader, value: "203.0.113.7, 198.51.100.9, 10.1.1.1", clientIP: "198.51.100.9"},
+		{name: "trusted proxy without the header", remoteIP: "10.0.0.1", clientIP: "10.0.0.1"},
+		{name: "unknown client of the trusted proxy", remoteIP: "10.0.0.1", header: XForwardedForHeader, value: "unknown"},
+		{name: "obfuscated client of the Forwarded header", remoteIP: "10.0.0.1", header: ForwardedHeader, value: "for=unknown"},
+		{name: "IPv6 client of the Forwarded header", remoteIP: "192.0.2.1", header: ForwardedHeader, value: `for=192.0.2.43, for="[2001:db8::1]:4711";proto=https`, clientIP: "2001:db8::1"},
+		{name: "client with the port of the Forwarded header", remoteIP: "192.0.2.1", header: ForwardedHeader, value: `proto=https;For=203.0.113.7:4711`, clientIP: "203.0.113.7"},
+	}
+
+	for _, tc := range tests {
+		req := fasthttp.AcquireRequest()
+		if tc.header != "" {
+			req.Header.Set(tc.header, tc.value)
+		}
+
+		var reqCtx fasthttp.RequestCtx
+		reqCtx.Init(req, &net.TCPAddr{IP: net.ParseIP(tc.remoteIP), Port: 40000}, nil)
+		fasthttp.ReleaseRequest(req)
+
+		header := XForwardedForHeader
+		if tc.header == ForwardedHeader {
+			header = ForwardedHeader
+		}
+
+		clientIP := ClientIP(&reqCtx, trustedProxies, header)
+
+		switch {
+		case tc.clientIP == "" && clientIP != nil:
+			t.Errorf("%s: unknown client is identified as %s", tc.name, clientIP)
+		case tc.clientIP != "" && !clientIP.Equal(net.ParseIP(tc.clientIP)):
+			t.Errorf("%s: incorrect client IP address. Expected: %s and got %s", tc.name, tc.clientIP, clientIP)
+		}
+	}
+
+	// the header is not used without the trusted proxies
+	req := fasthttp.AcquireRequest()
+	req.Header.Set(XForwardedForHeader, "203.0.113.7")
+
+	var reqCtx fasthttp.RequestCtx
+	reqCtx.Init(req, &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000}, nil)
+	fasthttp.ReleaseRequest(req)
+
+	if clientIP := ClientIP(&reqCtx, nil, XForwardedForHeader); !clientIP.Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("Header is used without the trusted proxies: %s", clientIP)
+	}
+}
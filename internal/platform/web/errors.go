@@ -16,6 +16,19 @@ type ErrorResponse struct {
 	Fields []FieldError `json:"fields,omitempty"`
 }
 
+// ProblemDetails is the RFC 7807 body of the response sent to the client
+// when the request is blocked.
+type ProblemDetails struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	RequestID string `json:"requestId"`
+	Reason    string `json:"reason,omitempty"`
+	Pointer   string `json:"pointer,omitempty"`
+	Parameter string `json:"parameter,omitempty"`
+}
+
 // Error is used to pass an error during the request through the
 // application with web specific context.
 type Error struct {
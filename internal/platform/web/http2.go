@@ -0,0 +1,388 @@
+package web
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+	"golang.org/x/net/http2"
+)
+
+// HTTP2Server serves HTTP/2 and HTTP/1.1 on the same listener. HTTP/2 is
+// negotiated by TLS ALPN or, on the plaintext listener, detected by the
+// connection preface of the client (h2c with prior knowledge). HTTP/1.1
+// connections are served by the fasthttp server. HTTP/2 streams are converted
+// to the fasthttp requests and handled by the handler of the fasthttp server,
+// so the middlewares and the validation are the same for both protocols.
+type HTTP2Server struct {
+	server *fasthttp.Server
+	logger *logrus.Logger
+
+	h2       *http2.Server
+	hs       *http.Server
+	errorLog *io.PipeWriter
+
+	mutex    sync.Mutex
+	ln       net.Listener
+	h1       *connListener
+	shutdown bool
+}
+
+// NewHTTP2Server returns the HTTP/2 server of the fasthttp server. The
+// timeouts of the fasthttp server are used by the HTTP/2 connections.
+func NewHTTP2Server(server *fasthttp.Server, logger *logrus.Logger) (*HTTP2Server, error) {
+	s := HTTP2Server{
+		server:   server,
+		logger:   logger,
+		h2:       &http2.Server{IdleTimeout: server.IdleTimeout},
+		errorLog: logger.WriterLevel(logrus.DebugLevel),
+	}
+
+	s.hs = &http.Server{
+		ReadTimeout:  server.ReadTimeout,
+		WriteTimeout: server.WriteTimeout,
+		ErrorLog:     log.New(s.errorLog, "", 0),
+	}
+
+	// graceful shutdown of the HTTP/2 connections is started by the shutdown of the base server
+	if err := http2.ConfigureServer(s.hs, s.h2); err != nil {
+		s.errorLog.Close()
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+// ListenAndServe serves HTTP/1.1 and h2c on the TCP network address
+func (s *HTTP2Server) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp4", addr)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(ln)
+}
+
+// ListenAndServeTLS serves HTTP/1.1 and HTTP/2 over TLS on the TCP network
+// address. The TLS configuration of the fasthttp server is used with the
+// certificate of the files.
+func (s *HTTP2Server) ListenAndServeTLS(addr, certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+
+	tlsConfig := &tls.Config{}
+	if s.server.TLSConfig != nil {
+		tlsConfig = s.server.TLSConfig.Clone()
+	}
+	tlsConfig.Certificates = append(tlsConfig.Certificates, cert)
+	tlsConfig.NextProtos = []string{http2.NextProtoTLS, "http/1.1"}
+
+	ln, err := net.Listen("tcp4", addr)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(tls.NewListener(ln, tlsConfig))
+}
+
+// Serve accepts the connections of the listener until the shutdown
+func (s *HTTP2Server) Serve(ln net.Listener) error {
+	s.mutex.Lock()
+	if s.shutdown {
+		s.mutex.Unlock()
+		ln.Close()
+		return nil
+	}
+	s.ln = ln
+	s.h1 = newConnListener(ln.Addr())
+	s.mutex.Unlock()
+
+	go func() {
+		if err := s.server.Serve(s.h1); err != nil {
+			s.logger.Errorf("HTTP/1.1 server error: %s", err)
+		}
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.mutex.Lock()
+			shutdown := s.shutdown
+			s.mutex.Unlock()
+
+			if shutdown {
+				return nil
+			}
+
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Temporary() {
+				s.logger.Errorf("HTTP/2 server: accept error: %s", err)
+				time.Sleep(time.Second)
+				continue
+			}
+
+			s.h1.Close()
+			return err
+		}
+
+		go s.dispatch(conn)
+	}
+}
+
+// Shutdown stops accepting the connections, sends GOAWAY to the HTTP/2
+// connections and gracefully shuts down the fasthttp server
+func (s *HTTP2Server) Shutdown() error {
+	s.mutex.Lock()
+	s.shutdown = true
+	ln := s.ln
+	s.mutex.Unlock()
+
+	if ln != nil {
+		ln.Close()
+	}
+
+	// there are no listeners and connections of the base server, only the
+	// shutdown hook of the HTTP/2 connections is run
+	s.hs.Shutdown(context.Background())
+	s.errorLog.Close()
+
+	return s.server.Shutdown()
+}
+
+// dispatch passes the connection to the HTTP/2 or the HTTP/1.1 server
+func (s *HTTP2Server) dispatch(conn net.Conn) {
+	if s.server.ReadTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(s.server.ReadTimeout))
+	}
+
+	h2, conn, err := negotiate(conn)
+	if err != nil {
+		s.logger.Debugf("HTTP/2 server: %s: %s", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	conn.SetReadDeadline(time.Time{})
+
+	if !h2 {
+		s.h1.push(conn)
+		return
+	}
+
+	s.h2.ServeConn(conn, &http2.ServeConnOpts{
+		BaseConfig: s.hs,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			s.serveStream(conn, w, r)
+		}),
+	})
+}
+
+// negotiate checks whether the client speaks HTTP/2. The TLS connection is
+// checked by the ALPN protocol. The HTTP/1.1 request differs from the preface
+// in the first bytes, so the plaintext connection is read only as far as the
+// bytes match the preface.
+func negotiate(conn net.Conn) (bool, net.Conn, error) {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			return false, conn, err
+		}
+		return tlsConn.ConnectionState().NegotiatedProtocol == http2.NextProtoTLS, conn, nil
+	}
+
+	r := bufio.NewReaderSize(conn, len(http2.ClientPreface))
+	peeked := &peekedConn{Conn: conn, r: r}
+
+	for n := 1; n <= len(http2.ClientPreface); n++ {
+		b, err := r.Peek(n)
+		if err != nil {
+			return false, conn, err
+		}
+		if b[n-1] != http2.ClientPreface[n-1] {
+			return false, peeked, nil
+		}
+	}
+
+	return true, peeked, nil
+}
+
+// serveStream handles the HTTP/2 request by the handler of the fasthttp
+// server. The request context uses the connection of the stream, so the
+// remote address and the TLS state are the same as of HTTP/1.1 requests.
+func (s *HTTP2Server) serveStream(conn net.Conn, w http.ResponseWriter, r *http.Request) {
+	// the start time of the context is set by the fasthttp server only
+	start := time.Now()
+
+	maxBodySize := s.server.MaxRequestBodySize
+	if maxBodySize <= 0 {
+		maxBodySize = fasthttp.DefaultMaxRequestBodySize
+	}
+
+	if r.ContentLength > int64(maxBodySize) {
+		http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, int64(maxBodySize)+1))
+	if err != nil {
+		http.Error(w, "Error when parsing request", http.StatusBadRequest)
+		return
+	}
+	if len(body) > maxBodySize {
+		http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var logger fasthttp.Logger = s.logger
+	if s.server.Logger != nil {
+		logger = s.server.Logger
+	}
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Init2(conn, logger, false)
+	ctx.SetUserValue(RequestTimeLabel, start)
+
+	ctx.Request.Header.SetMethod(r.Method)
+	ctx.Request.SetRequestURI(r.RequestURI)
+	ctx.Request.Header.SetHost(r.Host)
+
+	for name, values := range r.Header {
+		if name == fasthttp.HeaderContentLength {
+			continue
+		}
+		for _, value := range values {
+			ctx.Request.Header.Add(name, value)
+		}
+	}
+
+	if len(body) > 0 {
+		ctx.Request.SetBody(body)
+		ctx.Request.Header.SetContentLength(len(body))
+	}
+
+	if ctx.Request.Header.IsHead() {
+		ctx.Response.SkipBody = true
+	}
+
+	s.server.Handler(ctx)
+
+	writeResponse(w, &ctx.Response)
+}
+
+// RequestTime returns the time the request has been received. The time of
+// the HTTP/2 request is the time the stream has been accepted.
+func RequestTime(ctx *fasthttp.RequestCtx) time.Time {
+	if start, ok := ctx.UserValue(RequestTimeLabel).(time.Time); ok {
+		return start
+	}
+	return ctx.Time()
+}
+
+// writeResponse writes the fasthttp response to the HTTP/2 stream. The
+// connection-specific headers are not allowed by HTTP/2.
+func writeResponse(w http.ResponseWriter, resp *fasthttp.Response) {
+	header := w.Header()
+
+	resp.Header.VisitAll(func(key, value []byte) {
+		switch string(key) {
+		case fasthttp.HeaderConnection, fasthttp.HeaderContentLength, fasthttp.HeaderTransferEncoding:
+			return
+		}
+		header.Add(string(key), string(value))
+	})
+
+	statusCode := resp.StatusCode()
+	skipBody := resp.SkipBody || statusCode < fasthttp.StatusOK ||
+		statusCode == fasthttp.StatusNoContent || statusCode == fasthttp.StatusNotModified
+
+	if resp.IsBodyStream() {
+		w.WriteHeader(statusCode)
+		if !skipBody {
+			resp.BodyWriteTo(w)
+		}
+		return
+	}
+
+	switch {
+	case !skipBody:
+		header.Set(fasthttp.HeaderContentLength, strconv.Itoa(len(resp.Body())))
+	case resp.Header.ContentLength() >= 0:
+		// the length of the body of the response to HEAD request
+		header.Set(fasthttp.HeaderContentLength, strconv.Itoa(resp.Header.ContentLength()))
+	}
+
+	w.WriteHeader(statusCode)
+	if !skipBody {
+		w.Write(resp.Body())
+	}
+}
+
+// peekedConn is the connection with the bytes read while the protocol of the
+// connection is detected
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// connListener is the listener of the HTTP/1.1 connections of the fasthttp
+// server
+type connListener struct {
+	addr  net.Addr
+	conns chan net.Conn
+
+	once sync.Once
+	done chan struct{}
+}
+
+func newConnListener(addr net.Addr) *connListener {
+	return &connListener{
+		addr:  addr,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+// push passes the connection to the fasthttp server. The connection is
+// closed if the listener is closed.
+func (l *connListener) push(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		// the fasthttp server stops serving on EOF
+		return nil, io.EOF
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
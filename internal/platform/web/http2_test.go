@@ -0,0 +1,67 @@
+package web
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+	"golang.org/x/net/http2"
+)
+
+func TestHTTP2RequestTime(t *testing.T) {
+
+	latencies := make(chan time.Duration, 1)
+
+	server := fasthttp.Server{
+		Handler: func(ctx *fasthttp.RequestCtx) {
+			time.Sleep(10 * time.Millisecond)
+			latencies <- time.Since(RequestTime(ctx))
+		},
+		ReadTimeout:  time.Second,
+		WriteTimeout: time.Second,
+	}
+
+	h2Server, err := NewHTTP2Server(&server, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go h2Server.Serve(ln)
+	defer h2Server.Shutdown()
+
+	// h2c with prior knowledge
+	client := http.Client{
+		Timeout: time.Second,
+		Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+				return net.Dial(network, addr)
+			},
+		},
+	}
+
+	resp, err := client.Get("http://" + ln.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("Incorrect protocol of the response. Expected: HTTP/2 and got %s", resp.Proto)
+	}
+
+	if latency := <-latencies; latency < 10*time.Millisecond || latency > time.Second {
+		t.Errorf("Incorrect latency of the HTTP/2 request: %s", latency)
+	}
+}
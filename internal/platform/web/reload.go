@@ -0,0 +1,31 @@
+package web
+
+import (
+	"sync/atomic"
+
+	"github.com/valyala/fasthttp"
+)
+
+// ReloadableHandler holds the current request handler and allows replacing
+// it without interrupting the requests that are already being processed.
+type ReloadableHandler struct {
+	handler atomic.Value
+}
+
+// NewReloadableHandler creates a ReloadableHandler which serves requests with
+// the handler until it is replaced.
+func NewReloadableHandler(handler fasthttp.RequestHandler) *ReloadableHandler {
+	h := ReloadableHandler{}
+	h.handler.Store(handler)
+	return &h
+}
+
+// Swap replaces the current handler. New requests are served by the new handler.
+func (h *ReloadableHandler) Swap(handler fasthttp.RequestHandler) {
+	h.handler.Store(handler)
+}
+
+// Handler is the fasthttp.RequestHandler which passes requests to the current handler.
+func (h *ReloadableHandler) Handler(ctx *fasthttp.RequestCtx) {
+	h.handler.Load().(fasthttp.RequestHandler)(ctx)
+}
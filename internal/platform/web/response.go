@@ -2,9 +2,12 @@ package web
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 
 	"github.com/valyala/fasthttp"
+
+	"github.com/wallarm/api-firewall/internal/config"
 )
 
 // Respond converts a Go value to JSON and sends it to the client.
@@ -48,6 +51,47 @@ func RespondError(ctx *fasthttp.RequestCtx, statusCode int, statusHeader *string
 	return nil
 }
 
+// RespondProblem sends an error response with the RFC 7807 problem details body back to the client.
+func RespondProblem(ctx *fasthttp.RequestCtx, statusCode int, problem *ProblemDetails, statusHeader *string) error {
+
+	jsonData, err := json.Marshal(problem)
+	if err != nil {
+		return err
+	}
+
+	ctx.Response.Reset()
+	ctx.SetStatusCode(statusCode)
+	ctx.SetContentType(ProblemDetailsContentType)
+	ctx.SetBody(jsonData)
+
+	// Add validation status header
+	if statusHeader != nil {
+		ctx.Response.Header.Add(ValidationStatus, *statusHeader)
+	}
+
+	return nil
+}
+
+// RespondBlocked sends the response to the request blocked by the firewall.
+// The response contains the RFC 7807 problem details body if it is enabled in
+// the configuration.
+func RespondBlocked(ctx *fasthttp.RequestCtx, cfg *config.APIFWConfiguration, statusCode int, title, reason string) error {
+
+	if !cfg.ProblemDetailsResponse {
+		return RespondError(ctx, statusCode, nil)
+	}
+
+	problem := ProblemDetails{
+		Type:      ProblemDetailsDefaultType,
+		Title:     title,
+		Status:    statusCode,
+		RequestID: fmt.Sprintf("%016X", ctx.ID()),
+		Reason:    reason,
+	}
+
+	return RespondProblem(ctx, statusCode, &problem, nil)
+}
+
 // Redirect302 redirects client with code 302
 func Redirect302(ctx *fasthttp.RequestCtx, redirectUrl string) error {
 
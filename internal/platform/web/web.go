@@ -2,6 +2,7 @@ package web
 
 import (
 	"os"
+	"strconv"
 	"syscall"
 
 	"github.com/fasthttp/router"
@@ -9,11 +10,24 @@ import (
 	"github.com/valyala/fasthttp"
 
 	"github.com/wallarm/api-firewall/internal/config"
+	"github.com/wallarm/api-firewall/internal/platform/metrics"
 )
 
 const (
 	ValidationStatus = "APIFW-Validation-Status"
 
+	// ClientLabel is the user value of the request with the client of the API key
+	ClientLabel = "apifw_client"
+
+	// CountryLabel is the user value of the request with the country of the client IP address
+	CountryLabel = "apifw_country"
+
+	// RequestTimeLabel is the user value of the request with the time the HTTP/2 stream has been accepted
+	RequestTimeLabel = "apifw_request_time"
+
+	ProblemDetailsContentType = "application/problem+json"
+	ProblemDetailsDefaultType = "about:blank"
+
 	ValidationDisable = "DISABLE"
 	ValidationBlock   = "BLOCK"
 	ValidationLog     = "LOG_ONLY"
@@ -43,6 +57,7 @@ func ShadowAPIChecks(ctx *fasthttp.RequestCtx, logger *logrus.Logger, shadowApi
 		}
 	}
 	if !foundInExcluded {
+		metrics.ShadowAPIRequests.WithLabelValues(metrics.Method(ctx.Request.Header.Method()), strconv.Itoa(ctx.Response.StatusCode())).Inc()
 		logger.Errorf("#%016X : Shadow API : %s -> %s %s : %d (response length: %d)", ctx.ID(), ctx.RemoteAddr(),
 			ctx.Request.Header.Method(), ctx.Path(), ctx.Response.StatusCode(), ctx.Response.Header.ContentLength())
 	}
@@ -55,37 +70,46 @@ func (a *App) SetDefaultBehavior(handler Handler, mw ...Middleware) {
 	// Add the application's general middleware to the handler chain.
 	handler = wrapMiddleware(a.mw, handler)
 
-	customHandler := func(ctx *fasthttp.RequestCtx) {
+	defaultHandler := func(reason string) fasthttp.RequestHandler {
+		return func(ctx *fasthttp.RequestCtx) {
+
+			// Block request if it's not found in the route
+			if a.cfg.RequestValidation == ValidationBlock || a.cfg.ResponseValidation == ValidationBlock {
+				a.Log.Infof("#%016X: Request Forbidden: %s -> %s %s",
+					ctx.ID(),
+					ctx.RemoteAddr(),
+					ctx.Request.Header.Method(), ctx.Path(),
+				)
+				if err := RespondBlocked(ctx, a.cfg, a.cfg.CustomBlockStatusCode, "Request blocked", reason); err != nil {
+					a.Log.Errorf("#%016X: Error while sending response: %v", ctx.ID(), err)
+				}
+				return
+			}
+
+			if err := handler(ctx); err != nil {
+				a.SignalShutdown()
+				return
+			}
 
-		// Block request if it's not found in the route
-		if a.cfg.RequestValidation == ValidationBlock || a.cfg.ResponseValidation == ValidationBlock {
-			a.Log.Infof("#%016X: Request Forbidden: %s -> %s %s",
-				ctx.ID(),
-				ctx.RemoteAddr(),
-				ctx.Request.Header.Method(), ctx.Path(),
-			)
-			ctx.Error("", a.cfg.CustomBlockStatusCode)
-			return
 		}
-
-		if err := handler(ctx); err != nil {
-			a.SignalShutdown()
-			return
-		}
-
 	}
 
 	//Set NOT FOUND behavior
-	a.Router.NotFound = customHandler
+	a.Router.NotFound = defaultHandler("route not found")
 
 	// Set Method Not Allowed behavior
-	a.Router.MethodNotAllowed = customHandler
+	a.Router.MethodNotAllowed = defaultHandler("method not allowed")
 }
 
 // NewApp creates an App value that handle a set of routes for the application.
 func NewApp(shutdown chan os.Signal, cfg *config.APIFWConfiguration, logger *logrus.Logger, mw ...Middleware) *App {
+	r := router.New()
+
+	// the path of the matched route is used as the label of the request metrics
+	r.SaveMatchedRoutePath = true
+
 	app := App{
-		Router:   router.New(),
+		Router:   r,
 		shutdown: shutdown,
 		mw:       mw,
 		Log:      logger,